@@ -0,0 +1,187 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal2cri
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+// FollowerOptions configures a Follower.
+type FollowerOptions struct {
+	// Writer receives every entry read from the journal.
+	Writer *Writer
+	// CursorFile, if set, persists the journal read position so that Run
+	// resumes from the last acknowledged entry across restarts instead of
+	// replaying (or dropping) log history.
+	CursorFile string
+	// PartialWindow, if non-zero, coalesces consecutive partial lines
+	// (see PartialAssembler) before they reach Writer instead of writing
+	// each piece out separately.
+	PartialWindow time.Duration
+}
+
+// Follower tails a systemd journal directory and feeds each entry to a
+// Writer, persisting its cursor so that restarts resume where the
+// previous run left off.
+type Follower struct {
+	journalDir string
+	opts       FollowerOptions
+	assembler  *PartialAssembler
+}
+
+// NewFollower returns a Follower that tails the journal rooted at dir.
+func NewFollower(dir string, opts FollowerOptions) *Follower {
+	return &Follower{journalDir: dir, opts: opts}
+}
+
+// Run follows the journal until ctx is cancelled, writing every entry it
+// sees through opts.Writer and periodically persisting its cursor.
+func (f *Follower) Run(ctx context.Context) error {
+	cursor, err := f.loadCursor()
+	if err != nil {
+		log.Printf("journal2cri: could not load cursor, starting from now: %v", err)
+	}
+
+	if f.opts.PartialWindow > 0 {
+		f.assembler = NewPartialAssembler(f.opts.PartialWindow, func(e *CRIEntry) {
+			if err := f.opts.Writer.WriteEntry(e); err != nil {
+				log.Printf("journal2cri: could not write entry: %v", err)
+			}
+		})
+	}
+
+	cfg := sdjournal.JournalReaderConfig{
+		Path:      f.journalDir,
+		Cursor:    cursor,
+		Formatter: f.formatEntry,
+	}
+	if cursor == "" {
+		// No prior position recorded: start from the tail rather than
+		// replaying the pod's entire journal history. JournalReaderConfig
+		// only honors Since if it's non-zero, so an explicit zero value
+		// here would be indistinguishable from leaving it unset and fall
+		// through to the reader's head-seek default; NumFromTail: 1 is the
+		// field that actually trips a tail seek.
+		cfg.NumFromTail = 1
+	}
+
+	jr, err := sdjournal.NewJournalReader(cfg)
+	if err != nil {
+		return fmt.Errorf("could not open journal reader for %q: %v", f.journalDir, err)
+	}
+	defer jr.Close()
+
+	cursorDone := make(chan struct{})
+	go func() {
+		defer close(cursorDone)
+		f.persistCursorUntil(ctx, jr)
+	}()
+
+	until := make(chan time.Time)
+	go func() {
+		<-ctx.Done()
+		close(until)
+	}()
+
+	err = jr.Follow(until, ioutil.Discard)
+	<-cursorDone
+	if err != nil {
+		return fmt.Errorf("journal follow for %q ended: %v", f.journalDir, err)
+	}
+	return nil
+}
+
+// formatEntry is the sdjournal.JournalReader Formatter: rather than
+// formatting a string for the reader to write out, it writes the entry to
+// opts.Writer directly and returns nothing for the reader to emit.
+func (f *Follower) formatEntry(entry *sdjournal.JournalEntry) (string, error) {
+	criEntry := ProcessEntry(entry)
+	if criEntry == nil {
+		return "", nil
+	}
+	if f.assembler != nil {
+		f.assembler.Feed(criEntry)
+		return "", nil
+	}
+	if err := f.opts.Writer.WriteEntry(criEntry); err != nil {
+		log.Printf("journal2cri: could not write entry: %v", err)
+	}
+	return "", nil
+}
+
+func (f *Follower) persistCursorUntil(ctx context.Context, jr *sdjournal.JournalReader) {
+	if f.opts.CursorFile == "" {
+		<-ctx.Done()
+		return
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			f.saveCursor(jr)
+			return
+		case <-ticker.C:
+			f.saveCursor(jr)
+		}
+	}
+}
+
+func (f *Follower) saveCursor(jr *sdjournal.JournalReader) {
+	cursor, err := jr.Journal.GetCursor()
+	if err != nil {
+		log.Printf("journal2cri: could not read journal cursor: %v", err)
+		return
+	}
+	if err := f.writeCursor(cursor); err != nil {
+		log.Printf("journal2cri: could not persist journal cursor: %v", err)
+	}
+}
+
+func (f *Follower) loadCursor() (string, error) {
+	if f.opts.CursorFile == "" {
+		return "", nil
+	}
+	b, err := ioutil.ReadFile(f.opts.CursorFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (f *Follower) writeCursor(cursor string) error {
+	if f.opts.CursorFile == "" || cursor == "" {
+		return nil
+	}
+	tmp := f.opts.CursorFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(cursor), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.opts.CursorFile)
+}
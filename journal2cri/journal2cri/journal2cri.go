@@ -18,10 +18,7 @@ limitations under the License.
 package journal2cri
 
 import (
-	"fmt"
 	"log"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -61,11 +58,26 @@ func ProcessEntry(entry *sdjournal.JournalEntry) *CRIEntry {
 		return nil
 	}
 
+	// A message that doesn't end in a newline means the writer's line got
+	// split mid-line, most commonly by the 16KiB container-runtime pipe
+	// buffer; tag it Partial so a later entry can be coalesced onto it.
+	// Otherwise it's a complete line on its own.
+	message := entry.Fields["MESSAGE"]
+	tag := CRITagFull
+	if !strings.HasSuffix(message, "\n") {
+		tag = CRITagPartial
+	} else {
+		message = strings.TrimSuffix(message, "\n")
+	}
+
 	return &CRIEntry{
 		AppName:    appName,
 		AppAttempt: appNumber,
-		Message:    entry.Fields["MESSAGE"],
+		PID:        entry.Fields["_PID"],
+		Message:    message,
 		StreamType: CRIStreamType(outStream),
+		Tag:        tag,
+		Priority:   entry.Fields["PRIORITY"],
 		Timestamp:  time.Unix(0, int64(time.Duration(entry.RealtimeTimestamp)*time.Microsecond)),
 	}
 }
@@ -77,28 +89,26 @@ const (
 	CRIStreamStderr               = "stderr"
 )
 
+// CRITagType is the CRI v1 log format's partial/full line tag: "P" marks a
+// line kubelet should expect a continuation of, "F" marks a complete line.
+type CRITagType string
+
+const (
+	CRITagPartial CRITagType = "P"
+	CRITagFull    CRITagType = "F"
+)
+
 type CRIEntry struct {
 	AppName    string
 	AppAttempt int
+	// PID identifies the journal entry's writer, used to correlate
+	// consecutive partial lines from the same process.
+	PID        string
 	Message    string
 	StreamType CRIStreamType
-	Timestamp  time.Time
-}
-
-// WriteEntry writes a CRI entry to a file at the expected location
-// TODO we really should be holding onto file ptrs, this constant reopen/closing is not good
-func WriteEntry(entry *CRIEntry, dir string) {
-	fileName := fmt.Sprintf("%s_%d_%s.log", entry.AppName, entry.AppAttempt, entry.StreamType)
-	path := filepath.Join(dir, fileName)
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
-	if err != nil {
-		log.Printf("could not open file for append: %v", err)
-		return
-	}
-	defer f.Close()
-
-	_, err = f.WriteString(fmt.Sprintf("%s %s %s\n", entry.Timestamp.Format(time.RFC3339Nano), entry.StreamType, entry.Message))
-	if err != nil {
-		log.Printf("could not append file: %v", err)
-	}
+	Tag        CRITagType
+	// Priority is the journald syslog PRIORITY field, if present; it's
+	// only used to populate the optional structured sidecar log.
+	Priority  string
+	Timestamp time.Time
 }
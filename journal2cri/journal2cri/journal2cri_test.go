@@ -31,6 +31,7 @@ func TestProcessEntry(t *testing.T) {
 				AppAttempt: 1,
 				Message:    "20/20",
 				StreamType: CRIStreamStdout,
+				Tag:        CRITagPartial,
 				Timestamp:  now,
 			},
 		},
@@ -48,6 +49,29 @@ func TestProcessEntry(t *testing.T) {
 				AppAttempt: 10,
 				Message:    "petrov",
 				StreamType: CRIStreamStderr,
+				Tag:        CRITagPartial,
+				Timestamp:  now,
+			},
+		},
+		{
+			In: sdjournal.JournalEntry{
+				RealtimeTimestamp: uint64(timeInMillis),
+				Fields: map[string]string{
+					"SYSLOG_IDENTIFIER": "myapp-1",
+					"_TRANSPORT":        "stdout",
+					"MESSAGE":           "complete line\n",
+					"_PID":              "123",
+					"PRIORITY":          "6",
+				},
+			},
+			Out: CRIEntry{
+				AppName:    "myapp",
+				AppAttempt: 1,
+				PID:        "123",
+				Message:    "complete line",
+				StreamType: CRIStreamStdout,
+				Tag:        CRITagFull,
+				Priority:   "6",
 				Timestamp:  now,
 			},
 		},
@@ -0,0 +1,112 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal2cri
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultPartialWindow bounds how long PartialAssembler waits for a
+// continuation of a partial log line before giving up and flushing it as
+// a (possibly still truncated) complete line.
+const DefaultPartialWindow = 5 * time.Second
+
+// PartialAssembler coalesces consecutive CRITagPartial entries from the
+// same app/attempt/pid into a single line, mirroring how the kubelet
+// reconstructs log lines a container runtime split because they crossed
+// the 16KiB pipe buffer.
+type PartialAssembler struct {
+	window time.Duration
+	emit   func(*CRIEntry)
+
+	mu      sync.Mutex
+	pending map[string]*pendingEntry
+}
+
+type pendingEntry struct {
+	entry CRIEntry
+	timer *time.Timer
+}
+
+// NewPartialAssembler returns an assembler that calls emit with each
+// completed entry, whether it arrived already-Full or was coalesced from
+// one or more Partial pieces. window <= 0 uses DefaultPartialWindow.
+func NewPartialAssembler(window time.Duration, emit func(*CRIEntry)) *PartialAssembler {
+	if window <= 0 {
+		window = DefaultPartialWindow
+	}
+	return &PartialAssembler{
+		window:  window,
+		emit:    emit,
+		pending: make(map[string]*pendingEntry),
+	}
+}
+
+// Feed processes a single entry, either emitting it directly (a complete
+// line with nothing already pending) or merging it into an in-flight
+// partial for the same app/attempt/pid.
+func (a *PartialAssembler) Feed(entry *CRIEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := partialKey(entry)
+	pending, ok := a.pending[key]
+	if !ok {
+		if entry.Tag == CRITagFull {
+			a.emit(entry)
+			return
+		}
+		a.pending[key] = &pendingEntry{
+			entry: *entry,
+			timer: time.AfterFunc(a.window, func() { a.flush(key) }),
+		}
+		return
+	}
+
+	pending.entry.Message += entry.Message
+	pending.entry.Tag = entry.Tag
+	if entry.Tag == CRITagFull {
+		pending.timer.Stop()
+		delete(a.pending, key)
+		a.emit(&pending.entry)
+		return
+	}
+	pending.timer.Reset(a.window)
+}
+
+// flush force-emits a still-pending partial once its window expires
+// without a terminating line ever showing up.
+func (a *PartialAssembler) flush(key string) {
+	a.mu.Lock()
+	pending, ok := a.pending[key]
+	if ok {
+		delete(a.pending, key)
+	}
+	a.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	pending.entry.Tag = CRITagFull
+	a.emit(&pending.entry)
+}
+
+func partialKey(entry *CRIEntry) string {
+	return entry.AppName + "_" + strconv.Itoa(entry.AppAttempt) + "_" + entry.PID
+}
@@ -0,0 +1,320 @@
+/*
+Copyright 2016 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package journal2cri
+
+import (
+	"compress/gzip"
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RotationPolicy mirrors the kubelet's container-log-max-size /
+// container-log-max-files semantics: rotate a log once it crosses
+// MaxSizeBytes, and keep at most MaxFiles rotated-away copies around.
+// A zero value disables rotation entirely.
+type RotationPolicy struct {
+	MaxSizeBytes int64
+	MaxFiles     int
+}
+
+// WriterOptions configures a Writer.
+type WriterOptions struct {
+	// MaxOpenFiles bounds how many *os.File handles Writer keeps live at
+	// once; the least-recently-written handle is closed to make room for
+	// a new one. Zero means unlimited.
+	MaxOpenFiles int
+	Rotation     RotationPolicy
+	// StructuredSidecar, when set, additionally writes each entry with a
+	// non-empty Priority as a JSON line to a "<key>.json" sidecar file, so
+	// log shippers like Fluent Bit can pick up severity without
+	// re-parsing the CRI log format.
+	StructuredSidecar bool
+}
+
+// Writer writes CRIEntry values to per-app-per-stream log files under a
+// directory, keeping an LRU cache of open *os.File handles instead of
+// opening and closing the file on every entry, and rotating files per
+// Rotation once they grow too large.
+type Writer struct {
+	dir  string
+	opts WriterOptions
+
+	mu    sync.Mutex
+	lru   *list.List // of *fileHandle, most-recently-used at the front
+	byKey map[string]*list.Element
+}
+
+type fileHandle struct {
+	key  string
+	path string
+	f    *os.File
+	size int64
+}
+
+// NewWriter creates a Writer that writes CRI log files into dir.
+func NewWriter(dir string, opts WriterOptions) *Writer {
+	return &Writer{
+		dir:   dir,
+		opts:  opts,
+		lru:   list.New(),
+		byKey: make(map[string]*list.Element),
+	}
+}
+
+// WriteEntry appends entry to the log file for its app/attempt/stream,
+// reusing an already-open handle when one exists, and rotates the file
+// right after the write once it has reached the configured size limit.
+func (w *Writer) WriteEntry(entry *CRIEntry) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := entryKey(entry)
+	fh, err := w.open(key, filepath.Join(w.dir, key+".log"))
+	if err != nil {
+		return err
+	}
+
+	line := []byte(fmt.Sprintf("%s %s %s %s\n", entry.Timestamp.Format(time.RFC3339Nano), entry.StreamType, entry.Tag, entry.Message))
+	n, err := fh.f.Write(line)
+	fh.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("could not append to %q: %v", fh.path, err)
+	}
+
+	if w.opts.Rotation.MaxSizeBytes > 0 && fh.size >= w.opts.Rotation.MaxSizeBytes {
+		w.rotate(key, fh)
+	}
+
+	if w.opts.StructuredSidecar && entry.Priority != "" {
+		if err := w.writeSidecar(key, entry); err != nil {
+			log.Printf("journal2cri: could not write structured sidecar for %q: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// writeSidecar appends entry as a JSON line to the structured sidecar file
+// for key. Callers must hold w.mu.
+func (w *Writer) writeSidecar(key string, entry *CRIEntry) error {
+	sidecarKey := key + ".json"
+	fh, err := w.open(sidecarKey, filepath.Join(w.dir, key+".json"))
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(structuredLogLine{
+		Timestamp: entry.Timestamp,
+		Stream:    entry.StreamType,
+		Tag:       entry.Tag,
+		Message:   entry.Message,
+		Priority:  entry.Priority,
+	})
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	n, err := fh.f.Write(b)
+	fh.size += int64(n)
+	return err
+}
+
+type structuredLogLine struct {
+	Timestamp time.Time     `json:"timestamp"`
+	Stream    CRIStreamType `json:"stream"`
+	Tag       CRITagType    `json:"tag"`
+	Message   string        `json:"message"`
+	Priority  string        `json:"priority"`
+}
+
+func entryKey(entry *CRIEntry) string {
+	return fmt.Sprintf("%s_%d_%s", entry.AppName, entry.AppAttempt, entry.StreamType)
+}
+
+// open returns the handle for cacheKey, opening path if there isn't
+// already one cached, and evicting the least-recently-used handle if
+// we're at MaxOpenFiles. Callers must hold w.mu.
+func (w *Writer) open(cacheKey, path string) (*fileHandle, error) {
+	if elem, ok := w.byKey[cacheKey]; ok {
+		w.lru.MoveToFront(elem)
+		return elem.Value.(*fileHandle), nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %q for append: %v", path, err)
+	}
+	info, err := f.Stat()
+	var size int64
+	if err == nil {
+		size = info.Size()
+	}
+
+	fh := &fileHandle{key: cacheKey, path: path, f: f, size: size}
+	elem := w.lru.PushFront(fh)
+	w.byKey[cacheKey] = elem
+
+	if w.opts.MaxOpenFiles > 0 {
+		for w.lru.Len() > w.opts.MaxOpenFiles {
+			w.evictOldest()
+		}
+	}
+	return fh, nil
+}
+
+// evictOldest closes and forgets the least-recently-used handle. Callers
+// must hold w.mu.
+func (w *Writer) evictOldest() {
+	elem := w.lru.Back()
+	if elem == nil {
+		return
+	}
+	fh := elem.Value.(*fileHandle)
+	if err := fh.f.Close(); err != nil {
+		log.Printf("journal2cri: could not close %q: %v", fh.path, err)
+	}
+	w.lru.Remove(elem)
+	delete(w.byKey, fh.key)
+}
+
+// rotate closes fh's current file, renames it aside, gzips it
+// asynchronously, and prunes old rotated copies beyond MaxFiles. Callers
+// must hold w.mu; fh is no longer valid once this returns.
+func (w *Writer) rotate(key string, fh *fileHandle) {
+	if err := fh.f.Close(); err != nil {
+		log.Printf("journal2cri: could not close %q for rotation: %v", fh.path, err)
+	}
+	if elem, ok := w.byKey[key]; ok {
+		w.lru.Remove(elem)
+		delete(w.byKey, key)
+	}
+
+	rotatedPath := fmt.Sprintf("%s.%s", fh.path, time.Now().UTC().Format(time.RFC3339))
+	if err := os.Rename(fh.path, rotatedPath); err != nil {
+		log.Printf("journal2cri: could not rotate %q: %v", fh.path, err)
+		return
+	}
+
+	maxFiles := w.opts.Rotation.MaxFiles
+	go func() {
+		if err := gzipAndRemove(rotatedPath, rotatedPath+".gz"); err != nil {
+			log.Printf("journal2cri: could not gzip rotated log %q: %v", rotatedPath, err)
+		}
+		if maxFiles > 0 {
+			if err := pruneRotated(fh.path, maxFiles); err != nil {
+				log.Printf("journal2cri: could not prune rotated logs for %q: %v", fh.path, err)
+			}
+		}
+	}()
+}
+
+// Close flushes and closes every open file handle.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var firstErr error
+	for w.lru.Len() > 0 {
+		elem := w.lru.Front()
+		fh := elem.Value.(*fileHandle)
+		if err := fh.f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		w.lru.Remove(elem)
+		delete(w.byKey, fh.key)
+	}
+	return firstErr
+}
+
+// HandleSignals closes all open handles on SIGHUP, so that an external log
+// rotation tool can safely move the underlying files out from under us;
+// the next WriteEntry call reopens them at their (possibly new) path. It
+// blocks until ctx is done.
+func (w *Writer) HandleSignals(ctx context.Context) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+			if err := w.Close(); err != nil {
+				log.Printf("journal2cri: error closing log handles on SIGHUP: %v", err)
+			}
+		}
+	}
+}
+
+func gzipAndRemove(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(out)
+	if _, err := io.Copy(gw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// pruneRotated deletes rotated-and-gzipped copies of base beyond the
+// newest maxFiles, oldest first.
+func pruneRotated(base string, maxFiles int) error {
+	matches, err := filepath.Glob(base + ".*.gz")
+	if err != nil {
+		return err
+	}
+	if len(matches) <= maxFiles {
+		return nil
+	}
+
+	sort.Strings(matches) // RFC3339 timestamps in the name sort chronologically
+	for _, path := range matches[:len(matches)-maxFiles] {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
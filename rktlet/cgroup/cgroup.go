@@ -0,0 +1,351 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cgroup translates CRI LinuxContainerResources into the cgroup
+// knobs (or, under cgroup v1, the systemd unit properties that map onto
+// them) rkt's stage1 reads out of a pod's delegated cgroup subtree.
+package cgroup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+
+	"k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// cgroupRoot is where the host mounts its cgroup hierarchy (v1's group of
+// per-controller mounts, or v2's single unified mount). It's a var
+// rather than a const so tests can point it at a fake tree.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroup2SuperMagic is CGROUP2_SUPER_MAGIC from linux/magic.h, used to
+// detect a unified cgroup v2 hierarchy via statfs.
+const cgroup2SuperMagic = 0x63677270
+
+// Isolator is a single systemd unit property constraining one resource
+// dimension of a pod's cgroup (e.g. {"MemoryMax", "1073741824"}).
+type Isolator struct {
+	Name  string
+	Value string
+}
+
+type isolatorFunc func(resources *runtime.LinuxContainerResources) ([]Isolator, error)
+
+// isolatorFuncs maps a controller name to the function that knows how to
+// turn LinuxContainerResources into isolator properties for it.
+var isolatorFuncs = map[string]isolatorFunc{
+	"cpu":    addCPULimit,
+	"memory": addMemoryLimit,
+	"pids":   addPidsLimit,
+	"io":     addIOLimit,
+}
+
+// v2OnlyIsolators requires a unified cgroup hierarchy: v1 has no
+// equivalent systemd property rktlet can delegate to stage1 for these.
+var v2OnlyIsolators = map[string]bool{
+	"pids": true,
+	"io":   true,
+}
+
+// MaybeAddIsolator appends the isolator properties for name to isolators
+// if that resource dimension is requested and supported on this host, or
+// returns an error if name isn't a controller we know how to handle, or
+// needs v2 and the host doesn't have it.
+func MaybeAddIsolator(isolators []Isolator, name string, resources *runtime.LinuxContainerResources) ([]Isolator, error) {
+	fn, ok := isolatorFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("cgroup: unsupported isolator %q", name)
+	}
+	if v2OnlyIsolators[name] && !IsCgroupUnified() {
+		return nil, fmt.Errorf("cgroup: isolator %q requires a unified (v2) cgroup hierarchy", name)
+	}
+
+	added, err := fn(resources)
+	if err != nil {
+		return nil, fmt.Errorf("cgroup: could not compute %q isolator: %v", name, err)
+	}
+	return append(isolators, added...), nil
+}
+
+// IsCgroupUnified reports whether the host is running a pure cgroup v2
+// (unified) hierarchy, as opposed to a cgroup v1 (or hybrid) layout.
+func IsCgroupUnified() bool {
+	if forceCgroupUnified != nil {
+		return *forceCgroupUnified
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(cgroupRoot, &stat); err != nil {
+		glog.Warningf("cgroup: could not statfs %q: %v", cgroupRoot, err)
+		return false
+	}
+	return int64(stat.Type) == cgroup2SuperMagic
+}
+
+// forceCgroupUnified lets tests fake IsCgroupUnified's result against a
+// scratch directory that obviously isn't really mounted as cgroupfs.
+var forceCgroupUnified *bool
+
+// GetEnabledV2Controllers returns the controllers the v2 hierarchy's root
+// has enabled, read from cgroup.controllers.
+func GetEnabledV2Controllers() ([]string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("could not read enabled v2 controllers: %v", err)
+	}
+	return strings.Fields(string(b)), nil
+}
+
+func v2ControllerEnabled(name string) bool {
+	controllers, err := GetEnabledV2Controllers()
+	if err != nil {
+		glog.Warningf("cgroup: %v", err)
+		return false
+	}
+	for _, c := range controllers {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addCPULimit emits the v1 CPUQuota= property, or under a unified
+// hierarchy both CPUWeight= (the scheduling weight derived from
+// CpuShares) and CPUQuota=, since CPUWeight alone only biases how CPU
+// time is split among competing cgroups and enforces no cap at all.
+func addCPULimit(resources *runtime.LinuxContainerResources) ([]Isolator, error) {
+	if resources == nil || resources.CpuQuota == 0 {
+		return nil, nil
+	}
+
+	period := resources.CpuPeriod
+	if period == 0 {
+		period = 100000 // the kernel's own default cpu.cfs_period_us
+	}
+	quotaPct := fmt.Sprintf("%d%%", resources.CpuQuota*100/period)
+
+	if IsCgroupUnified() {
+		if !v2ControllerEnabled("cpu") {
+			return nil, fmt.Errorf("cpu controller not enabled in the unified hierarchy")
+		}
+		return []Isolator{
+			{Name: "CPUWeight", Value: fmt.Sprintf("%d", cpuSharesToWeight(resources.CpuShares))},
+			{Name: "CPUQuota", Value: quotaPct},
+		}, nil
+	}
+
+	return []Isolator{{Name: "CPUQuota", Value: quotaPct}}, nil
+}
+
+// cpuSharesToWeight maps the legacy (2-262144) cpu.shares range onto
+// systemd's CPUWeight range (1-10000), the same linear mapping the kernel
+// itself uses to convert cpu.shares to cpu.weight under cgroup v2.
+func cpuSharesToWeight(shares int64) int64 {
+	if shares <= 0 {
+		shares = 1024 // cgroup v1's default
+	}
+	weight := 1 + ((shares-2)*9999)/262142
+	if weight < 1 {
+		weight = 1
+	}
+	if weight > 10000 {
+		weight = 10000
+	}
+	return weight
+}
+
+// addMemoryLimit emits the v1 MemoryLimit= property, or under a unified
+// hierarchy the v2-native MemoryMax=. The swap cap (capped identically,
+// since LinuxContainerResources has no separate swap field) is only
+// emitted when the host's kernel actually has swap accounting turned on;
+// constraining it on a host without CONFIG_MEMCG_SWAP (or without
+// swapaccount=1 on the kernel command line) fails outright and would
+// otherwise surface as a surprising pod OOM instead of a clear error.
+// The swap isolator's name differs by hierarchy: MemorySwapMax= is a
+// genuine (v2-only) systemd unit property, but v1 has no systemd
+// property for memory+swap at all, so the v1 branch emits
+// MemorySwapLimit, an isolator name managers recognize as "write
+// memory.memsw.limit_in_bytes directly" rather than something settable
+// over D-Bus.
+func addMemoryLimit(resources *runtime.LinuxContainerResources) ([]Isolator, error) {
+	if resources == nil || resources.MemoryLimitInBytes == 0 {
+		return nil, nil
+	}
+	limit := fmt.Sprintf("%d", resources.MemoryLimitInBytes)
+	swap := swapAccountingEnabled()
+	if !swap {
+		warnNoSwapAccountingOnce()
+	}
+
+	if IsCgroupUnified() {
+		if !v2ControllerEnabled("memory") {
+			return nil, fmt.Errorf("memory controller not enabled in the unified hierarchy")
+		}
+		isolators := []Isolator{{Name: "MemoryMax", Value: limit}}
+		if swap {
+			isolators = append(isolators, Isolator{Name: "MemorySwapMax", Value: limit})
+		}
+		return isolators, nil
+	}
+
+	isolators := []Isolator{{Name: "MemoryLimit", Value: limit}}
+	if swap {
+		isolators = append(isolators, Isolator{Name: "MemorySwapLimit", Value: limit})
+	}
+	return isolators, nil
+}
+
+// swapAccountingWarnOnce ensures the no-swap-accounting warning below is
+// only logged a single time per process, rather than once per container.
+var swapAccountingWarnOnce sync.Once
+
+func warnNoSwapAccountingOnce() {
+	swapAccountingWarnOnce.Do(func() {
+		glog.Warningf("cgroup: kernel swap accounting is unavailable (missing memory.memsw.limit_in_bytes or memory.swap.max); only constraining RSS, not swap")
+	})
+}
+
+// swapAccountingEnabled reports whether the kernel exposes swap
+// accounting for the memory controller: memory.memsw.limit_in_bytes
+// under cgroup v1, or memory.swap.max under the v2 unified hierarchy.
+// Neither file exists when the kernel lacks CONFIG_MEMCG_SWAP, or (v1
+// only) when swapaccount=1 wasn't passed on the kernel command line.
+func swapAccountingEnabled() bool {
+	if IsCgroupUnified() {
+		_, err := os.Stat(filepath.Join(cgroupRoot, "memory.swap.max"))
+		return err == nil
+	}
+	_, err := os.Stat(filepath.Join(cgroupRoot, "memory", "memory.memsw.limit_in_bytes"))
+	return err == nil
+}
+
+// addPidsLimit emits the v2-native TasksMax=. There's no v1 equivalent
+// rktlet supports, so this is only ever called once MaybeAddIsolator has
+// confirmed the host is unified.
+func addPidsLimit(resources *runtime.LinuxContainerResources) ([]Isolator, error) {
+	if resources == nil || resources.PidsLimit == 0 {
+		return nil, nil
+	}
+	if !v2ControllerEnabled("pids") {
+		return nil, fmt.Errorf("pids controller not enabled in the unified hierarchy")
+	}
+	return []Isolator{{Name: "TasksMax", Value: fmt.Sprintf("%d", resources.PidsLimit)}}, nil
+}
+
+// addIOLimit emits the v2-native IOWeight=, translated from the CRI's
+// legacy BlkioWeight (10-1000) by multiplying it by 10, which places it
+// at 100-10000 within systemd's 1-10000 IOWeight range (capped at 10000).
+func addIOLimit(resources *runtime.LinuxContainerResources) ([]Isolator, error) {
+	if resources == nil || resources.BlkioWeight == 0 {
+		return nil, nil
+	}
+	if !v2ControllerEnabled("io") {
+		return nil, fmt.Errorf("io controller not enabled in the unified hierarchy")
+	}
+	weight := int64(resources.BlkioWeight) * 10
+	if weight > 10000 {
+		weight = 10000
+	}
+	return []Isolator{{Name: "IOWeight", Value: fmt.Sprintf("%d", weight)}}, nil
+}
+
+// CreateV2Cgroups creates and delegates the unified-hierarchy subtree for
+// a pod at cgroupPath, populating cgroup.subtree_control so rkt's stage1
+// systemd can further subdivide it for each app.
+func CreateV2Cgroups(cgroupPath string) error {
+	fullPath := filepath.Join(cgroupRoot, cgroupPath)
+	if err := os.MkdirAll(fullPath, 0755); err != nil {
+		return fmt.Errorf("could not create v2 cgroup %q: %v", fullPath, err)
+	}
+
+	controllers, err := GetEnabledV2Controllers()
+	if err != nil {
+		return err
+	}
+
+	subtreeControl := make([]string, 0, len(controllers))
+	for _, c := range controllers {
+		subtreeControl = append(subtreeControl, "+"+c)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(fullPath, "cgroup.subtree_control"), []byte(strings.Join(subtreeControl, " ")), 0644); err != nil {
+		return fmt.Errorf("could not delegate controllers to %q: %v", fullPath, err)
+	}
+	return nil
+}
+
+// v1Controllers lists the cgroup v1 controller hierarchies rktlet's own
+// isolators (addCPULimit, addMemoryLimit) ever write into; unlike v2's
+// single unified tree, each needs its own per-controller mount.
+var v1Controllers = []string{"cpu", "memory"}
+
+// CreateV1Cgroups creates the pod's cgroup subdirectory under each v1
+// controller hierarchy rktlet writes isolators into. Unlike
+// CreateV2Cgroups, there's no subtree_control delegation step: v1's
+// per-controller directories are usable as soon as they exist.
+func CreateV1Cgroups(cgroupPath string) error {
+	for _, controller := range v1Controllers {
+		fullPath := filepath.Join(cgroupRoot, controller, cgroupPath)
+		if err := os.MkdirAll(fullPath, 0755); err != nil {
+			return fmt.Errorf("could not create v1 cgroup %q: %v", fullPath, err)
+		}
+	}
+	return nil
+}
+
+// RemountV2CgroupsRO bind-mounts the pod's unified cgroup subtree
+// read-only for the app, other than the specific knobs listed in rw,
+// which stay writable so stage1 can report resource usage / adjust
+// limits it's allowed to.
+//
+// fullPath is a plain directory inside the host's single cgroup2 mount,
+// not a mountpoint of its own, so it has to be bind-mounted onto itself
+// first to give it an independent vfsmount before MS_REMOUNT (which
+// requires its target to already be a mountpoint) can flip it read-only;
+// the vendored rkt/common/cgroup package's RemountV1CgroupsRO gets away
+// with a single combined MS_BIND|MS_REMOUNT call only because it targets
+// a controller root that's already its own mount from CreateV1Cgroups.
+// The rw knobs are bind-mounted in turn right after that self-bind and
+// before the final read-only remount, so each becomes its own child
+// mount that the remount (which only changes its own mount's flags, not
+// its children's) leaves writable.
+func RemountV2CgroupsRO(cgroupPath string, rw []string) error {
+	fullPath := filepath.Join(cgroupRoot, cgroupPath)
+
+	if err := syscall.Mount(fullPath, fullPath, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("could not bind-mount %q: %v", fullPath, err)
+	}
+
+	for _, knob := range rw {
+		knobPath := filepath.Join(fullPath, knob)
+		if err := syscall.Mount(knobPath, knobPath, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("could not bind-mount %q read-write: %v", knobPath, err)
+		}
+	}
+
+	if err := syscall.Mount("", fullPath, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("could not remount %q read-only: %v", fullPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// withFakeCgroupRoot points cgroupRoot at a fresh scratch directory for
+// the duration of fn, restoring the real value afterwards.
+func withFakeCgroupRoot(t *testing.T, unified bool, files map[string]string, fn func(root string)) {
+	t.Helper()
+
+	root, err := ioutil.TempDir("", "cgroup-test-")
+	if err != nil {
+		t.Fatalf("could not create scratch cgroup root: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	for rel, contents := range files {
+		path := filepath.Join(root, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("could not create %q: %v", filepath.Dir(path), err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("could not write %q: %v", path, err)
+		}
+	}
+
+	oldRoot, oldUnified := cgroupRoot, forceCgroupUnified
+	cgroupRoot = root
+	forceCgroupUnified = &unified
+	defer func() {
+		cgroupRoot = oldRoot
+		forceCgroupUnified = oldUnified
+	}()
+
+	fn(root)
+}
+
+func TestAddMemoryLimitSwapGating(t *testing.T) {
+	resources := &runtime.LinuxContainerResources{MemoryLimitInBytes: 1073741824}
+
+	tests := []struct {
+		name      string
+		unified   bool
+		files     map[string]string
+		wantNames []string
+	}{
+		{
+			name:      "v1 without swap accounting",
+			unified:   false,
+			files:     map[string]string{},
+			wantNames: []string{"MemoryLimit"},
+		},
+		{
+			name:      "v1 with swap accounting",
+			unified:   false,
+			files:     map[string]string{"memory/memory.memsw.limit_in_bytes": "0"},
+			wantNames: []string{"MemoryLimit", "MemorySwapLimit"},
+		},
+		{
+			name:      "v2 without swap",
+			unified:   true,
+			files:     map[string]string{"cgroup.controllers": "cpu memory pids io"},
+			wantNames: []string{"MemoryMax"},
+		},
+		{
+			name:    "v2 with swap",
+			unified: true,
+			files: map[string]string{
+				"cgroup.controllers": "cpu memory pids io",
+				"memory.swap.max":    "max",
+			},
+			wantNames: []string{"MemoryMax", "MemorySwapMax"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFakeCgroupRoot(t, tt.unified, tt.files, func(root string) {
+				isolators, err := addMemoryLimit(resources)
+				if err != nil {
+					t.Fatalf("addMemoryLimit: %v", err)
+				}
+
+				var gotNames []string
+				for _, iso := range isolators {
+					gotNames = append(gotNames, iso.Name)
+				}
+				if len(gotNames) != len(tt.wantNames) {
+					t.Fatalf("got isolators %v, want %v", gotNames, tt.wantNames)
+				}
+				for i, name := range tt.wantNames {
+					if gotNames[i] != name {
+						t.Fatalf("got isolators %v, want %v", gotNames, tt.wantNames)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestCpuSharesToWeight(t *testing.T) {
+	tests := []struct {
+		shares int64
+		want   int64
+	}{
+		{shares: 0, want: cpuSharesToWeight(1024)}, // falls back to the v1 default
+		{shares: 2, want: 1},
+		{shares: 262144, want: 10000},
+		{shares: 1024, want: cpuSharesToWeight(1024)},
+	}
+
+	for _, tt := range tests {
+		if got := cpuSharesToWeight(tt.shares); got != tt.want {
+			t.Errorf("cpuSharesToWeight(%d) = %d, want %d", tt.shares, got, tt.want)
+		}
+	}
+}
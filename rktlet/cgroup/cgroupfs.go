@@ -0,0 +1,179 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cgroup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// v2KnobFiles maps the systemd unit property names Isolator values are
+// expressed as onto the cgroup v2 knob file each one writes to. CPUQuota
+// isn't in here since, unlike the rest, its v2 knob (cpu.max) needs its
+// value reshaped rather than written as-is; see writeIsolators.
+var v2KnobFiles = map[string]string{
+	"CPUWeight":     "cpu.weight",
+	"MemoryMax":     "memory.max",
+	"MemorySwapMax": "memory.swap.max",
+	"TasksMax":      "pids.max",
+	"IOWeight":      "io.weight",
+}
+
+// v1KnobFiles maps the legacy (v1) isolator names onto the controller and
+// knob file each is written to. Unlike v2's single unified tree, v1
+// spreads its controllers across separate per-controller mounts, so each
+// entry needs its own controller directory. CPUQuota is handled
+// separately in writeIsolators for the same reshaping reason as v2.
+var v1KnobFiles = map[string]struct{ controller, file string }{
+	"MemoryLimit":     {"memory", "memory.limit_in_bytes"},
+	"MemorySwapLimit": {"memory", "memory.memsw.limit_in_bytes"},
+}
+
+// cgroupfsManager implements CgroupManager by creating and writing
+// directly into the cgroupfs hierarchy: CreateV2Cgroups and the v2 knob
+// files it delegates on a unified host, or CreateV1Cgroups and the
+// matching per-controller v1 knob files otherwise.
+type cgroupfsManager struct{}
+
+func newCgroupfsManager() *cgroupfsManager {
+	return &cgroupfsManager{}
+}
+
+func (m *cgroupfsManager) podCgroupPath(podUID string) string {
+	return filepath.Join("rktlet.slice", "pod-"+podUID+".scope")
+}
+
+func (m *cgroupfsManager) CreatePodCgroup(podUID string, resources *runtime.LinuxContainerResources) (string, error) {
+	cgroupPath := m.podCgroupPath(podUID)
+
+	var err error
+	if IsCgroupUnified() {
+		err = CreateV2Cgroups(cgroupPath)
+	} else {
+		err = CreateV1Cgroups(cgroupPath)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.writeIsolators(cgroupPath, resources); err != nil {
+		return "", err
+	}
+	return cgroupPath, nil
+}
+
+func (m *cgroupfsManager) UpdateResources(podUID string, resources *runtime.LinuxContainerResources) error {
+	return m.writeIsolators(m.podCgroupPath(podUID), resources)
+}
+
+func (m *cgroupfsManager) RemovePodCgroup(podUID string) error {
+	cgroupPath := m.podCgroupPath(podUID)
+	if IsCgroupUnified() {
+		if err := os.Remove(filepath.Join(cgroupRoot, cgroupPath)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove pod cgroup %q: %v", podUID, err)
+		}
+		return nil
+	}
+	for _, controller := range v1Controllers {
+		if err := os.Remove(filepath.Join(cgroupRoot, controller, cgroupPath)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove pod cgroup %q: %v", podUID, err)
+		}
+	}
+	return nil
+}
+
+func (m *cgroupfsManager) writeIsolators(cgroupPath string, resources *runtime.LinuxContainerResources) error {
+	isolators, err := isolatorsForResources(resources)
+	if err != nil {
+		return err
+	}
+
+	for _, iso := range isolators {
+		if iso.Name == "CPUQuota" {
+			if err := writeCPUQuota(cgroupPath, iso.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if IsCgroupUnified() {
+			knob, ok := v2KnobFiles[iso.Name]
+			if !ok {
+				continue
+			}
+			knobPath := filepath.Join(cgroupRoot, cgroupPath, knob)
+			if err := ioutil.WriteFile(knobPath, []byte(iso.Value), 0644); err != nil {
+				return fmt.Errorf("could not write %q: %v", knobPath, err)
+			}
+			continue
+		}
+
+		knob, ok := v1KnobFiles[iso.Name]
+		if !ok {
+			continue
+		}
+		knobPath := filepath.Join(cgroupRoot, knob.controller, cgroupPath, knob.file)
+		if err := ioutil.WriteFile(knobPath, []byte(iso.Value), 0644); err != nil {
+			return fmt.Errorf("could not write %q: %v", knobPath, err)
+		}
+	}
+	return nil
+}
+
+// writeCPUQuota writes the CPUQuota isolator's "NN%" value to whichever
+// cpu controller knob the host actually has: cpu.max (v2, which packs
+// quota and period into one "$quota $period" knob) or cpu.cfs_quota_us
+// (v1, a lone microseconds-of-period-us value, read alongside the
+// kernel's own cpu.cfs_period_us default of 100000 that the percentage
+// was computed against).
+func writeCPUQuota(cgroupPath, pct string) error {
+	quotaUs, err := cpuQuotaPercentToQuotaUs(pct)
+	if err != nil {
+		return fmt.Errorf("cgroup: isolator CPUQuota=%q: %v", pct, err)
+	}
+
+	if IsCgroupUnified() {
+		knobPath := filepath.Join(cgroupRoot, cgroupPath, "cpu.max")
+		if err := ioutil.WriteFile(knobPath, []byte(fmt.Sprintf("%d 100000", quotaUs)), 0644); err != nil {
+			return fmt.Errorf("could not write %q: %v", knobPath, err)
+		}
+		return nil
+	}
+
+	knobPath := filepath.Join(cgroupRoot, "cpu", cgroupPath, "cpu.cfs_quota_us")
+	if err := ioutil.WriteFile(knobPath, []byte(fmt.Sprintf("%d", quotaUs)), 0644); err != nil {
+		return fmt.Errorf("could not write %q: %v", knobPath, err)
+	}
+	return nil
+}
+
+// cpuQuotaPercentToQuotaUs converts a "NN%" CPUQuota isolator value into
+// the microseconds-of-cpu.cfs_period_us-default(100000) quota both
+// cpu.cfs_quota_us (v1) and cpu.max (v2) expect as their quota half.
+func cpuQuotaPercentToQuotaUs(pct string) (int64, error) {
+	n, err := strconv.ParseInt(strings.TrimSuffix(pct, "%"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a percentage: %v", err)
+	}
+	return n * 1000, nil
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cgroup
+
+import (
+	"fmt"
+
+	"k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// ManagerKind selects a CgroupManager implementation, mirroring the
+// --cgroup-manager flag kubelet, cri-o and containerd all expose.
+type ManagerKind string
+
+const (
+	// CgroupManagerCgroupfs manages pod cgroups by writing directly into
+	// the cgroupfs hierarchy, the behavior rktlet has always had.
+	CgroupManagerCgroupfs ManagerKind = "cgroupfs"
+	// CgroupManagerSystemd manages pod cgroups as transient systemd
+	// scopes, delegated to rkt's stage1 systemd to further subdivide.
+	CgroupManagerSystemd ManagerKind = "systemd"
+)
+
+// CgroupManager owns the lifecycle of a pod's top-level cgroup: creating
+// it before the pod's apps start, keeping its resource limits in sync
+// with updates, and tearing it down once the pod is gone.
+type CgroupManager interface {
+	// CreatePodCgroup creates the cgroup for podUID and applies resources
+	// to it, returning the path (relative to the cgroup root) rkt's
+	// stage1 should be told to use.
+	CreatePodCgroup(podUID string, resources *runtime.LinuxContainerResources) (string, error)
+	// UpdateResources applies updated resource limits to podUID's
+	// already-created cgroup.
+	UpdateResources(podUID string, resources *runtime.LinuxContainerResources) error
+	// RemovePodCgroup tears down podUID's cgroup.
+	RemovePodCgroup(podUID string) error
+}
+
+// NewCgroupManager returns the CgroupManager implementation selected by
+// kind, which is expected to come from rktlet's --cgroup-manager flag.
+func NewCgroupManager(kind ManagerKind) (CgroupManager, error) {
+	switch kind {
+	case CgroupManagerCgroupfs, "":
+		return newCgroupfsManager(), nil
+	case CgroupManagerSystemd:
+		return newSystemdManager()
+	default:
+		return nil, fmt.Errorf("cgroup: unknown --cgroup-manager %q", kind)
+	}
+}
+
+// isolatorsForResources computes the isolators applicable to resources on
+// this host, silently dropping v2-only isolators that don't apply rather
+// than treating them as an error: unlike MaybeAddIsolator's direct
+// callers, a manager doesn't know in advance which dimensions the host
+// can support.
+func isolatorsForResources(resources *runtime.LinuxContainerResources) ([]Isolator, error) {
+	var isolators []Isolator
+	for _, name := range []string{"cpu", "memory", "pids", "io"} {
+		if v2OnlyIsolators[name] && !IsCgroupUnified() {
+			continue
+		}
+		added, err := MaybeAddIsolator(isolators, name, resources)
+		if err != nil {
+			return nil, err
+		}
+		isolators = added
+	}
+	return isolators, nil
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cgroup
+
+import "testing"
+
+func TestCPUQuotaPercentToUSec(t *testing.T) {
+	tests := []struct {
+		pct     string
+		want    uint64
+		wantErr bool
+	}{
+		{pct: "50%", want: 500000},
+		{pct: "100%", want: 1000000},
+		{pct: "0%", want: 0},
+		{pct: "not-a-percent", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := cpuQuotaPercentToUSec(tt.pct)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("cpuQuotaPercentToUSec(%q): expected an error, got %d", tt.pct, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cpuQuotaPercentToUSec(%q): unexpected error: %v", tt.pct, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cpuQuotaPercentToUSec(%q) = %d, want %d", tt.pct, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	rktapi "github.com/rkt/rkt/api/v1alpha"
+	context "golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// listImagesAPI is ListImages's rkt api-service backed implementation,
+// used in place of the CLI-scraping one when s.apiClient is set.
+func (s *ImageStore) listImagesAPI(ctx context.Context, req *runtime.ListImagesRequest) (*runtime.ListImagesResponse, error) {
+	resp, err := s.apiClient.ListImages(ctx, &rktapi.ListImagesRequest{Filters: imageFiltersFromCRI(req.Filter)})
+	if err != nil {
+		return nil, fmt.Errorf("could not list images via the rkt api-service: %v", err)
+	}
+
+	images := make([]*runtime.Image, 0, len(resp.Images))
+	for _, img := range resp.Images {
+		criImg := apiImageToCRI(img)
+		if !passFilter(criImg, req.Filter) {
+			continue
+		}
+		images = append(images, criImg)
+	}
+	return &runtime.ListImagesResponse{Images: images}, nil
+}
+
+// imageFiltersFromCRI translates a CRI ImageFilter into the api-service's
+// own filter list. The api-service's ImageFilter only supports prefix
+// matching, not the exact match CRI's ImageFilter wants (the CLI path's
+// passFilter is exact), so this is only a coarse server-side pre-filter
+// to cut down what crosses the wire; listImagesAPI still runs passFilter
+// itself against the results to reject same-prefix-but-different-name
+// false positives (e.g. "myapp" also matching "myapp-worker").
+func imageFiltersFromCRI(filter *runtime.ImageFilter) []*rktapi.ImageFilter {
+	name := filter.GetImage().GetImage()
+	if name == "" {
+		return nil
+	}
+	return []*rktapi.ImageFilter{{Prefixes: []string{name}}}
+}
+
+// apiImageToCRI maps an rktapi.Image's annotations directly to
+// RepoTags/RepoDigests, the same appc.io/docker/originalname and
+// appc.io/docker/manifesthash annotations getImageMetadata reads via a
+// separate cat-manifest exec in the CLI path.
+func apiImageToCRI(img *rktapi.Image) *runtime.Image {
+	id := img.Id
+	size := uint64(img.Size)
+	criImg := &runtime.Image{Id: &id, Size_: &size}
+
+	var originalName, manifestHash string
+	for _, ann := range img.Annotations {
+		switch ann.Key {
+		case "appc.io/docker/originalname":
+			originalName = ann.Value
+		case "appc.io/docker/manifesthash":
+			manifestHash = ann.Value
+		}
+	}
+
+	if originalName == "" {
+		originalName = img.Name
+	}
+	criImg.RepoTags = []string{originalName}
+
+	if manifestHash != "" {
+		repo, _, err := splitRef(originalName)
+		if err != nil {
+			repo = originalName
+		}
+		criImg.RepoDigests = []string{fmt.Sprintf("docker-pullable://%s@sha256:%s", repo, strings.TrimPrefix(manifestHash, "sha256:"))}
+	}
+
+	return criImg
+}
@@ -20,6 +20,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -29,7 +32,10 @@ import (
 	"github.com/kubernetes-incubator/rktlet/rktlet/util"
 
 	appcschema "github.com/appc/spec/schema"
+	rktapi "github.com/rkt/rkt/api/v1alpha"
 	context "golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
 	"k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
 )
 
@@ -43,59 +49,137 @@ var (
 // ImageStore supports CRUD operations for images.
 type ImageStore struct {
 	cli.CLI
-	requestTimeout time.Duration
+	requestTimeout     time.Duration
+	ociFetcher         ImageFetcher
+	insecureRegistries []string
+	// pullGroup coalesces concurrent PullImageWithPolicy calls for the
+	// same normalized image reference into a single `rkt image fetch`.
+	pullGroup singleflight.Group
+	// apiClient, if set, is used for ListImages/ImageStatus/RemoveImage
+	// instead of shelling out to the rkt CLI and scraping its output.
+	apiClient rktapi.PublicAPIClient
 }
 
 // TODO(tmrts): fill the image store configuration fields.
 type ImageStoreConfig struct {
 	CLI            cli.CLI
 	RequestTimeout time.Duration
+	// OCIFetcher, if set, is used by PullImageOCI to pull images directly
+	// from an OCI Distribution v2 registry instead of shelling out to
+	// `rkt image fetch`.
+	OCIFetcher ImageFetcher
+	// InsecureRegistries lists the registry hosts (e.g. "localhost:5000")
+	// that should be pulled from over plain HTTP / without TLS
+	// verification. Every other registry is pulled from securely, same as
+	// every other CRI runtime defaults to.
+	InsecureRegistries []string
+	// APIServiceEndpoint, if set, points ListImages/ImageStatus/RemoveImage
+	// at rkt's api-service gRPC endpoint (e.g. "localhost:15441") instead
+	// of the CLI. This avoids an exec per call and, for listing, a second
+	// exec per image to read its manifest. If dialing it fails, the store
+	// falls back to the CLI, same as if it had been left unset.
+	APIServiceEndpoint string
 }
 
 // NewImageStore creates an image storage that allows CRUD operations for images.
 func NewImageStore(cfg ImageStoreConfig) runtime.ImageServiceServer {
-	return &ImageStore{cfg.CLI, cfg.RequestTimeout}
+	s := &ImageStore{
+		CLI:                cfg.CLI,
+		requestTimeout:     cfg.RequestTimeout,
+		ociFetcher:         cfg.OCIFetcher,
+		insecureRegistries: cfg.InsecureRegistries,
+	}
+
+	if cfg.APIServiceEndpoint != "" {
+		conn, err := grpc.Dial(cfg.APIServiceEndpoint, grpc.WithInsecure())
+		if err != nil {
+			glog.Warningf("could not dial rkt api-service at %q, falling back to the CLI: %v", cfg.APIServiceEndpoint, err)
+		} else {
+			s.apiClient = rktapi.NewPublicAPIClient(conn)
+		}
+	}
+
+	return s
 }
 
-// Remove removes the image from the image store.
+// Remove removes the image from the image store. Removing an image that
+// isn't present is a no-op success, matching docker/CRI semantics.
 func (s *ImageStore) RemoveImage(ctx context.Context, req *runtime.RemoveImageRequest) (*runtime.RemoveImageResponse, error) {
-	img, err := s.ImageStatus(ctx, &runtime.ImageStatusRequest{Image: req.Image})
+	img, err := s.findImage(ctx, req.GetImage())
+	if err == ErrImageNotFound {
+		return &runtime.RemoveImageResponse{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err := s.RunCommand("image", "rm", *img.Image.Id); err != nil {
+	if s.apiClient != nil {
+		if _, err := s.apiClient.RmImage(ctx, &rktapi.RmImageRequest{Id: *img.Id}); err != nil {
+			return nil, fmt.Errorf("failed to remove the image via the rkt api-service: %v", err)
+		}
+		return &runtime.RemoveImageResponse{}, nil
+	}
+
+	if _, err := s.RunCommand("image", "rm", *img.Id); err != nil {
 		return nil, fmt.Errorf("failed to remove the image: %v", err)
 	}
 
 	return &runtime.RemoveImageResponse{}, nil
 }
 
-// ImageStatus returns the status of the image.
+// ImageStatus returns the status of the image, or an empty response (nil
+// Image) with no error if it isn't present: per the CRI contract, a
+// missing image is not a runtime failure, and a nil Image with a nil
+// error lets the kubelet tell the two apart and decide whether to pull.
 // TODO(euank): rkt should support listing a single image so this is more
 // efficient
 func (s *ImageStore) ImageStatus(ctx context.Context, req *runtime.ImageStatusRequest) (*runtime.ImageStatusResponse, error) {
-	images, err := s.ListImages(ctx, &runtime.ListImagesRequest{})
+	img, err := s.findImage(ctx, req.GetImage())
+	if err == ErrImageNotFound {
+		return &runtime.ImageStatusResponse{}, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	reqImg := req.GetImage().GetImage()
-	// TODO this should be done in kubelet (see comment on ApplyDefaultImageTag)
-	reqImg, err = util.ApplyDefaultImageTag(reqImg)
+	return &runtime.ImageStatusResponse{Image: img}, nil
+}
+
+// findImage looks up spec among the store's images, returning
+// ErrImageNotFound if it isn't present. spec.Image may be either a
+// repo:tag (matched against RepoTags) or a repo@sha256:hex /
+// docker-pullable://repo@sha256:hex digest reference (matched against
+// RepoDigests), the same two forms kubelet looks images up by for other
+// CRI runtimes.
+func (s *ImageStore) findImage(ctx context.Context, spec *runtime.ImageSpec) (*runtime.Image, error) {
+	images, err := s.ListImages(ctx, &runtime.ListImagesRequest{})
 	if err != nil {
 		return nil, err
 	}
 
+	reqImg := strings.TrimPrefix(spec.GetImage(), "docker-pullable://")
+	byDigest := strings.Contains(reqImg, "@")
+	if !byDigest {
+		// TODO this should be done in kubelet (see comment on ApplyDefaultImageTag)
+		reqImg, err = util.ApplyDefaultImageTag(reqImg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	for _, img := range images.Images {
-		for _, name := range img.RepoTags {
-			if name == reqImg {
-				return &runtime.ImageStatusResponse{Image: img}, nil
+		names := img.RepoTags
+		if byDigest {
+			names = img.RepoDigests
+		}
+		for _, name := range names {
+			if strings.TrimPrefix(name, "docker-pullable://") == reqImg {
+				return img, nil
 			}
 		}
 	}
 
-	return nil, fmt.Errorf("couldn't find image %q", *req.Image.Image)
+	return nil, ErrImageNotFound
 }
 
 // TODO this should be exported by rkt upstream. This is a copy of https://github.com/coreos/rkt/blob/v1.19.0/rkt/image_list.go#L81-L87
@@ -108,29 +192,26 @@ type ImageListEntry struct {
 	Size       string `json:"size"`
 }
 
-// ListImages lists images in the store
+// ListImages lists images in the store. If the store was configured with
+// an APIServiceEndpoint, this talks to rkt's api-service over gRPC,
+// filtering server-side and reading each image's manifest annotations
+// out of the one response instead of CLI-scraping plus a cat-manifest
+// exec per image.
 func (s *ImageStore) ListImages(ctx context.Context, req *runtime.ListImagesRequest) (*runtime.ListImagesResponse, error) {
-	list, err := s.RunCommand("image", "list",
-		"--full",
-		"--format=json",
-		"--sort=importtime",
-	)
-	if err != nil {
-		return nil, fmt.Errorf("couldn't list images: %v", err)
+	if s.apiClient != nil {
+		return s.listImagesAPI(ctx, req)
 	}
 
-	listEntries := []ImageListEntry{}
-
-	err = json.Unmarshal([]byte(list[0]), &listEntries)
+	listEntries, err := s.listCLIEntries()
 	if err != nil {
-		return nil, fmt.Errorf("could not unmarshal images into expected format: %v", err)
+		return nil, err
 	}
 
-	images := make([]*runtime.Image, 0, len(list))
+	images := make([]*runtime.Image, 0, len(listEntries))
 	for _, img := range listEntries {
 		img := img
 
-		realName := s.getImageRealName(img.ID)
+		realName, repoDigest := s.getImageMetadata(img.ID)
 		if realName == "" {
 			realName = img.Name
 		}
@@ -140,10 +221,15 @@ func (s *ImageStore) ListImages(ctx context.Context, req *runtime.ListImagesRequ
 			sz = 0
 		}
 
+		var repoDigests []string
+		if repoDigest != "" {
+			repoDigests = []string{repoDigest}
+		}
+
 		image := &runtime.Image{
 			Id:          &img.ID,
 			RepoTags:    []string{img.Name},
-			RepoDigests: []string{img.ID},
+			RepoDigests: repoDigests,
 			Size_:       &sz,
 		}
 
@@ -155,29 +241,116 @@ func (s *ImageStore) ListImages(ctx context.Context, req *runtime.ListImagesRequ
 	return &runtime.ListImagesResponse{Images: images}, nil
 }
 
-func (s *ImageStore) getImageRealName(id string) string {
+// listCLIEntries runs `rkt image list` and unmarshals its JSON output, the
+// raw listing both ListImages's CLI path and PruneImages build on.
+func (s *ImageStore) listCLIEntries() ([]ImageListEntry, error) {
+	list, err := s.RunCommand("image", "list",
+		"--full",
+		"--format=json",
+		"--sort=importtime",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list images: %v", err)
+	}
+
+	listEntries := []ImageListEntry{}
+	if err := json.Unmarshal([]byte(list[0]), &listEntries); err != nil {
+		return nil, fmt.Errorf("could not unmarshal images into expected format: %v", err)
+	}
+	return listEntries, nil
+}
+
+// getImageMetadata fetches id's appc manifest and returns its original
+// docker name (repo:tag) and, if docker2aci recorded the manifest digest
+// it was pulled under, the canonical docker-pullable://repo@sha256:hex
+// reference kubelet expects to see in RepoDigests. Either return value is
+// "" if the corresponding annotation isn't present (e.g. the image
+// wasn't pulled from a docker registry).
+func (s *ImageStore) getImageMetadata(id string) (realName, repoDigest string) {
 	imgManifest, err := s.RunCommand("image", "cat-manifest", id)
 	var manifest appcschema.ImageManifest
 
 	err = json.Unmarshal([]byte(strings.Join(imgManifest, "")), &manifest)
 	if err != nil {
 		glog.Warningf("unable to unmarshal image %q manifest into appc: %v", id, err)
-		return ""
+		return "", ""
 	}
 
-	originalName, ok := manifest.GetAnnotation("appc.io/docker/originalname")
+	realName, ok := manifest.GetAnnotation("appc.io/docker/originalname")
 	if !ok {
 		glog.Warningf("image %q does not have originalname annotation", id)
-		return ""
+		return "", ""
 	}
-	return originalName
+
+	digest, ok := manifest.GetAnnotation("appc.io/docker/manifesthash")
+	if !ok {
+		return realName, ""
+	}
+	repo, _, err := splitRef(realName)
+	if err != nil {
+		repo = realName
+	}
+	repoDigest = fmt.Sprintf("docker-pullable://%s@sha256:%s", repo, strings.TrimPrefix(digest, "sha256:"))
+
+	return realName, repoDigest
 }
 
-// PullImage pulls an image into the store
+// PullImage pulls an image into the store, authenticating against the
+// registry with req.Auth if it's set. CRI's PullImage has always been a
+// "pull if missing" operation, so this goes through PullImageWithPolicy
+// under PullPolicyMissing, short-circuiting without touching the
+// registry when the image is already present; concurrent PullImage calls
+// for the same not-yet-present image (e.g. several pods scheduled onto
+// this node at once) still coalesce into a single fetch by s.pullGroup
+// instead of each racing off to `rkt image fetch`/the OCI fetcher
+// independently.
 func (s *ImageStore) PullImage(ctx context.Context, req *runtime.PullImageRequest) (*runtime.PullImageResponse, error) {
-	// TODO auth
-	output, err := s.RunCommand("image", "fetch", "--no-store=true", "--insecure-options=image,ondisk", "--full=true", "docker://"+*req.Image.Image)
+	return s.PullImageWithPolicy(ctx, req, PullPolicyMissing)
+}
 
+// fetchImage does the actual work of getting ref into the local store, the
+// part PullImageWithPolicy's singleflight group dedups: it pulls over the
+// OCI Distribution v2 protocol via s.ociFetcher if one was configured,
+// otherwise it falls back to `rkt image fetch` via the CLI.
+func (s *ImageStore) fetchImage(ctx context.Context, req *runtime.PullImageRequest) (*runtime.PullImageResponse, error) {
+	if s.ociFetcher != nil {
+		return s.PullImageOCI(ctx, req)
+	}
+	return s.pullImageCLI(ctx, req)
+}
+
+// pullImageCLI pulls an image into the store by shelling out to
+// `rkt image fetch`, authenticating against the registry with req.Auth if
+// it's set.
+func (s *ImageStore) pullImageCLI(ctx context.Context, req *runtime.PullImageRequest) (*runtime.PullImageResponse, error) {
+	authDir, err := writeAuthDir(req.GetAuth(), *req.Image.Image)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up registry auth: %v", err)
+	}
+	if authDir != "" {
+		defer os.RemoveAll(authDir)
+	}
+
+	args := []string{"fetch", "--no-store=true", "--full=true"}
+	if s.isInsecureRegistry(*req.Image.Image) {
+		args = append(args, "--insecure-options=image,ondisk")
+	}
+	args = append(args, "docker://"+*req.Image.Image)
+
+	// --user-config is a global rkt flag and has to precede the `image`
+	// subcommand, unlike --insecure-options/--no-store/--full above which
+	// are flags of `image fetch` itself. RunCommand's first argument is
+	// just whatever word rkt should see first, so passing it there and
+	// folding the usual "image" subcommand into args keeps the two in
+	// the right order without growing RunCommand's signature for this
+	// one global flag.
+	cmd := "image"
+	if authDir != "" {
+		cmd = "--user-config=" + authDir
+		args = append([]string{"image"}, args...)
+	}
+
+	output, err := s.RunCommand(cmd, args...)
 	if err != nil {
 		return nil, fmt.Errorf("unable to fetch image: %v", err)
 	}
@@ -188,6 +361,53 @@ func (s *ImageStore) PullImage(ctx context.Context, req *runtime.PullImageReques
 	return &runtime.PullImageResponse{}, nil
 }
 
+// isInsecureRegistry reports whether ref's registry host was configured
+// as insecure via ImageStoreConfig.InsecureRegistries.
+func (s *ImageStore) isInsecureRegistry(ref string) bool {
+	host := refRegistryHost(ref)
+	for _, insecure := range s.insecureRegistries {
+		if insecure == host {
+			return true
+		}
+	}
+	return false
+}
+
+// PullImageOCI pulls an image by speaking the OCI Distribution v2
+// protocol directly instead of shelling out to `rkt image fetch`, so
+// registries that only serve OCI manifests (not docker2aci-compatible)
+// can still be pulled from. It fetches and verifies the manifest/layers
+// into a scratch OCI layout directory, converts the result to an ACI, and
+// hands that off to rkt the same way a plain `rkt fetch` would.
+func (s *ImageStore) PullImageOCI(ctx context.Context, req *runtime.PullImageRequest) (*runtime.PullImageResponse, error) {
+	if s.ociFetcher == nil {
+		return nil, fmt.Errorf("no OCI fetcher configured")
+	}
+
+	workDir, err := ioutil.TempDir("", "rktlet-oci-pull-")
+	if err != nil {
+		return nil, fmt.Errorf("could not create scratch directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	layoutDir := filepath.Join(workDir, "layout")
+	configDigest, manifest, err := s.ociFetcher.Fetch(*req.Image.Image, layoutDir, req.GetAuth(), s.isInsecureRegistry(*req.Image.Image))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch %q: %v", *req.Image.Image, err)
+	}
+
+	aciPath, err := ociToACI(layoutDir, configDigest, manifest, workDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert %q to ACI: %v", *req.Image.Image, err)
+	}
+
+	if _, err := s.RunCommand("fetch", "--insecure-options=image", aciPath); err != nil {
+		return nil, fmt.Errorf("could not fetch converted ACI into the store: %v", err)
+	}
+
+	return &runtime.PullImageResponse{}, nil
+}
+
 // passFilter returns whether the target image satisfies the filter.
 func passFilter(image *runtime.Image, filter *runtime.ImageFilter) bool {
 	if filter == nil {
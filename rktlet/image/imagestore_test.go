@@ -0,0 +1,123 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"testing"
+
+	context "golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// fakeCLI is a minimal cli.CLI that answers `image list` with a fixed
+// JSON payload and records whether any other command was run.
+type fakeCLI struct {
+	listJSON  string
+	otherCall func(cmd string, args ...string) ([]string, error)
+}
+
+func (f *fakeCLI) RunCommand(cmd string, args ...string) ([]string, error) {
+	if cmd == "image" && len(args) > 0 && args[0] == "list" {
+		return []string{f.listJSON}, nil
+	}
+	if f.otherCall != nil {
+		return f.otherCall(cmd, args...)
+	}
+	return nil, fmt.Errorf("unexpected command: %s %v", cmd, args)
+}
+
+func newTestImageStore(cli *fakeCLI) *ImageStore {
+	return &ImageStore{CLI: cli}
+}
+
+func imageSpecFor(name string) *runtime.ImageSpec {
+	return &runtime.ImageSpec{Image: &name}
+}
+
+func TestImageStatusMissingImage(t *testing.T) {
+	s := newTestImageStore(&fakeCLI{listJSON: "[]"})
+
+	resp, err := s.ImageStatus(context.Background(), &runtime.ImageStatusRequest{Image: imageSpecFor("docker.io/library/busybox:latest")})
+	if err != nil {
+		t.Fatalf("ImageStatus returned an error for a missing image: %v", err)
+	}
+	if resp == nil {
+		t.Fatal("ImageStatus returned a nil response for a missing image, want an empty one")
+	}
+	if resp.Image != nil {
+		t.Fatalf("ImageStatus returned Image %+v for a missing image, want nil", resp.Image)
+	}
+}
+
+func TestImageStatusFoundImage(t *testing.T) {
+	listJSON := `[{"id":"sha512-abc","name":"docker.io/library/busybox:latest","importtime":"0","lastused":"0","size":"100"}]`
+	s := newTestImageStore(&fakeCLI{
+		listJSON: listJSON,
+		otherCall: func(cmd string, args ...string) ([]string, error) {
+			return []string{""}, nil
+		},
+	})
+
+	resp, err := s.ImageStatus(context.Background(), &runtime.ImageStatusRequest{Image: imageSpecFor("docker.io/library/busybox:latest")})
+	if err != nil {
+		t.Fatalf("ImageStatus: %v", err)
+	}
+	if resp.Image == nil {
+		t.Fatal("ImageStatus returned a nil Image for a present image")
+	}
+	if *resp.Image.Id != "sha512-abc" {
+		t.Errorf("ImageStatus returned id %q, want %q", *resp.Image.Id, "sha512-abc")
+	}
+}
+
+func TestImageStatusFoundByDigest(t *testing.T) {
+	listJSON := `[{"id":"sha512-abc","name":"docker.io/library/busybox:latest","importtime":"0","lastused":"0","size":"100"}]`
+	manifest := `{"acKind":"ImageManifest","acVersion":"0.8.10","name":"busybox","annotations":[` +
+		`{"name":"appc.io/docker/originalname","value":"docker.io/library/busybox:latest"},` +
+		`{"name":"appc.io/docker/manifesthash","value":"sha256:deadbeef"}]}`
+	s := newTestImageStore(&fakeCLI{
+		listJSON: listJSON,
+		otherCall: func(cmd string, args ...string) ([]string, error) {
+			return []string{manifest}, nil
+		},
+	})
+
+	ref := "docker-pullable://docker.io/library/busybox@sha256:deadbeef"
+	resp, err := s.ImageStatus(context.Background(), &runtime.ImageStatusRequest{Image: imageSpecFor(ref)})
+	if err != nil {
+		t.Fatalf("ImageStatus: %v", err)
+	}
+	if resp.Image == nil {
+		t.Fatalf("ImageStatus found nothing for digest ref %q", ref)
+	}
+	if len(resp.Image.RepoDigests) != 1 || resp.Image.RepoDigests[0] != ref {
+		t.Errorf("ImageStatus returned RepoDigests %v, want [%q]", resp.Image.RepoDigests, ref)
+	}
+}
+
+func TestRemoveImageMissingImageIsNoOp(t *testing.T) {
+	s := newTestImageStore(&fakeCLI{listJSON: "[]"})
+
+	resp, err := s.RemoveImage(context.Background(), &runtime.RemoveImageRequest{Image: imageSpecFor("docker.io/library/busybox:latest")})
+	if err != nil {
+		t.Fatalf("RemoveImage returned an error for a missing image: %v", err)
+	}
+	if resp == nil {
+		t.Fatal("RemoveImage returned a nil response for a missing image, want an empty success")
+	}
+}
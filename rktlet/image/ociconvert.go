@@ -0,0 +1,281 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	appcschema "github.com/appc/spec/schema"
+	appctypes "github.com/appc/spec/schema/types"
+	digest "github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ociToACI unpacks manifest's layers from layoutDir into a rootfs,
+// assembles an ACI manifest from the OCI config blob configDigest, and
+// writes out an uncompressed ACI image at the returned path,
+// ready to hand to `rkt fetch --insecure-options=image`.
+func ociToACI(layoutDir string, configDigest digest.Digest, manifest ociv1.Manifest, workDir string) (string, error) {
+	config, err := readConfig(layoutDir, configDigest)
+	if err != nil {
+		return "", err
+	}
+
+	rootfs := filepath.Join(workDir, "rootfs")
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return "", err
+	}
+	for _, layer := range manifest.Layers {
+		if err := unpackLayer(blobPath(layoutDir, layer.Digest), rootfs); err != nil {
+			return "", fmt.Errorf("could not unpack layer %s: %v", layer.Digest, err)
+		}
+	}
+
+	aciManifest, err := buildACIManifest(config)
+	if err != nil {
+		return "", err
+	}
+
+	aciPath := filepath.Join(workDir, "image.aci")
+	if err := writeACI(aciPath, aciManifest, rootfs); err != nil {
+		return "", err
+	}
+	return aciPath, nil
+}
+
+func readConfig(layoutDir string, configDigest digest.Digest) (*ociv1.Image, error) {
+	b, err := ioutil.ReadFile(blobPath(layoutDir, configDigest))
+	if err != nil {
+		return nil, fmt.Errorf("could not read image config: %v", err)
+	}
+	var config ociv1.Image
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("could not parse image config: %v", err)
+	}
+	return &config, nil
+}
+
+func blobPath(layoutDir string, d digest.Digest) string {
+	return filepath.Join(layoutDir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// unpackLayer extracts a gzip'd tar layer into root, the same
+// whiteout-unaware way docker2aci does for a first cut (full OCI
+// whiteout ".wh." handling is left as a follow-up).
+func unpackLayer(layerPath, root string) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := containedPath(root, hdr.Name)
+		if err != nil {
+			return fmt.Errorf("layer entry %q: %v", hdr.Name, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		case tar.TypeSymlink:
+			if _, err := containedPath(root, filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)); err != nil {
+				return fmt.Errorf("layer entry %q: symlink target %q: %v", hdr.Name, hdr.Linkname, err)
+			}
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// containedPath joins root and name (a tar header path, untrusted since
+// it comes straight from whatever registry the image reference resolves
+// to) and verifies the result is still under root, rejecting the
+// classic tar-slip escape (e.g. name = "../../../../etc/cron.d/evil").
+func containedPath(root, name string) (string, error) {
+	target := filepath.Join(root, name)
+	rootWithSep := root + string(filepath.Separator)
+	if target != root && !strings.HasPrefix(target, rootWithSep) {
+		return "", fmt.Errorf("escapes extraction root %q", root)
+	}
+	return target, nil
+}
+
+// buildACIManifest maps the fields of an OCI image config onto the ACI
+// app manifest fields that have a direct equivalent.
+func buildACIManifest(config *ociv1.Image) (*appcschema.ImageManifest, error) {
+	name, err := appctypes.NewACIdentifier("rktlet.io/oci-pulled-image")
+	if err != nil {
+		return nil, err
+	}
+
+	app := &appcschema.App{
+		User:  config.Config.User,
+		Group: "0",
+	}
+	if app.User == "" {
+		app.User = "0"
+	}
+	if config.Config.WorkingDir != "" {
+		app.WorkingDirectory = config.Config.WorkingDir
+	}
+	app.Exec = append(append([]string{}, config.Config.Entrypoint...), config.Config.Cmd...)
+
+	for _, e := range config.Config.Env {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		app.Environment = append(app.Environment, appctypes.EnvironmentVariable{Name: parts[0], Value: parts[1]})
+	}
+
+	for port := range config.Config.ExposedPorts {
+		p, proto, err := parseExposedPort(port)
+		if err != nil {
+			continue
+		}
+		app.Ports = append(app.Ports, appctypes.Port{
+			Name:     *appctypes.MustACIdentifier(fmt.Sprintf("port-%d-%s", p, proto)),
+			Protocol: proto,
+			Port:     uint(p),
+		})
+	}
+
+	var labels appctypes.Labels
+	for k, v := range config.Config.Labels {
+		l, err := appctypes.NewACIdentifier(k)
+		if err != nil {
+			continue
+		}
+		labels = append(labels, appctypes.Label{Name: *l, Value: v})
+	}
+
+	return &appcschema.ImageManifest{
+		ACKind:    "ImageManifest",
+		ACVersion: appcschema.AppContainerVersion,
+		Name:      *name,
+		Labels:    labels,
+		App:       app,
+	}, nil
+}
+
+func parseExposedPort(port string) (int, string, error) {
+	parts := strings.SplitN(port, "/", 2)
+	proto := "tcp"
+	if len(parts) == 2 {
+		proto = parts[1]
+	}
+	var p int
+	if _, err := fmt.Sscanf(parts[0], "%d", &p); err != nil {
+		return 0, "", err
+	}
+	return p, proto, nil
+}
+
+// writeACI tars up manifest + rootfs into an uncompressed ACI at path.
+func writeACI(path string, manifest *appcschema.ImageManifest, rootfs string) error {
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest", Mode: 0644, Size: int64(len(manifestBytes))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestBytes); err != nil {
+		return err
+	}
+
+	return filepath.Walk(rootfs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootfs, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.Join("rootfs", rel)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
@@ -0,0 +1,395 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	criruntime "k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// Manifest media types an ImageFetcher should be willing to accept, in
+// preference order: OCI's own manifest type first, falling back to the
+// docker v2 manifest most registries still serve by default, and the OCI
+// image index for multi-arch selection.
+var acceptedManifestTypes = []string{
+	ociv1.MediaTypeImageManifest,
+	"application/vnd.docker.distribution.manifest.v2+json",
+	ociv1.MediaTypeImageIndex,
+}
+
+// ImageFetcher pulls an image from an OCI Distribution v2 registry into a
+// local OCI image-layout directory (the config and layer blobs under
+// blobs/<algo>/<hex>, plus oci-layout), without shelling out to another
+// tool. No index.json is written, and the manifest itself is returned
+// rather than stored as a blob.
+type ImageFetcher interface {
+	// Fetch pulls ref (e.g. "docker.io/library/busybox:latest") into
+	// layoutDir, selecting the manifest matching GOOS/GOARCH out of a
+	// multi-arch index if necessary, and returns the image's config
+	// digest and manifest so the caller can unpack its layers. auth, if
+	// non-nil, is exchanged for a bearer token via the registry's
+	// WWW-Authenticate challenge the same way docker/containerd do;
+	// insecure selects plain HTTP instead of HTTPS, for registries
+	// configured as insecure.
+	Fetch(ref, layoutDir string, auth *criruntime.AuthConfig, insecure bool) (digest.Digest, ociv1.Manifest, error)
+}
+
+// registryFetcher is the default ImageFetcher, speaking the OCI
+// Distribution v2 HTTP API directly.
+type registryFetcher struct {
+	client *http.Client
+}
+
+// NewRegistryFetcher returns an ImageFetcher that talks to registries over
+// OCI Distribution v2, authenticating per-pull via whatever auth is
+// passed to Fetch.
+func NewRegistryFetcher(client *http.Client) ImageFetcher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &registryFetcher{client: client}
+}
+
+func (f *registryFetcher) Fetch(ref, layoutDir string, auth *criruntime.AuthConfig, insecure bool) (digest.Digest, ociv1.Manifest, error) {
+	repo, reference, err := splitRef(ref)
+	if err != nil {
+		return "", ociv1.Manifest{}, err
+	}
+
+	creds, _ := authCredentials(auth)
+	scheme := "https"
+	if insecure {
+		scheme = "http"
+	}
+	sess := &fetchSession{client: f.client, scheme: scheme, creds: creds}
+
+	manifest, mediaType, err := sess.getManifest(repo, reference)
+	if err != nil {
+		return "", ociv1.Manifest{}, err
+	}
+
+	if mediaType == ociv1.MediaTypeImageIndex || mediaType == "application/vnd.docker.distribution.manifest.list.v2+json" {
+		manifest, mediaType, err = sess.resolveFromIndex(repo, manifest)
+		if err != nil {
+			return "", ociv1.Manifest{}, err
+		}
+	}
+
+	var m ociv1.Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return "", ociv1.Manifest{}, fmt.Errorf("could not parse manifest for %q: %v", ref, err)
+	}
+
+	if err := initLayout(layoutDir); err != nil {
+		return "", ociv1.Manifest{}, err
+	}
+
+	if err := sess.fetchBlob(repo, m.Config.Digest, m.Config.Size, layoutDir); err != nil {
+		return "", ociv1.Manifest{}, fmt.Errorf("could not fetch config blob: %v", err)
+	}
+	for _, layer := range m.Layers {
+		if err := sess.fetchBlob(repo, layer.Digest, layer.Size, layoutDir); err != nil {
+			return "", ociv1.Manifest{}, fmt.Errorf("could not fetch layer %s: %v", layer.Digest, err)
+		}
+	}
+
+	return m.Config.Digest, m, nil
+}
+
+// fetchSession is the state for one Fetch call: the scheme (http/https,
+// per the insecure-registries config) and registry credentials to
+// exchange for a bearer token on the first 401, plus the token itself
+// once obtained so the rest of the pull's requests (manifest, each blob)
+// reuse it instead of renegotiating per-request.
+type fetchSession struct {
+	client *http.Client
+	scheme string
+	creds  dockerCredentials
+	token  string
+}
+
+// resolveFromIndex picks the manifest matching this host's GOOS/GOARCH out
+// of a multi-arch image index and fetches it.
+func (s *fetchSession) resolveFromIndex(repo string, indexBytes []byte) ([]byte, string, error) {
+	var index ociv1.Index
+	if err := json.Unmarshal(indexBytes, &index); err != nil {
+		return nil, "", fmt.Errorf("could not parse image index: %v", err)
+	}
+
+	for _, desc := range index.Manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.OS == goruntime.GOOS && desc.Platform.Architecture == goruntime.GOARCH {
+			return s.getManifest(repo, desc.Digest.String())
+		}
+	}
+	return nil, "", fmt.Errorf("no manifest in index matches %s/%s", goruntime.GOOS, goruntime.GOARCH)
+}
+
+func (s *fetchSession) getManifest(repo, reference string) ([]byte, string, error) {
+	u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", s.scheme, registryHost(repo), repoPath(repo), reference)
+	resp, err := s.do(repo, "GET", u, func(req *http.Request) {
+		req.Header.Set("Accept", strings.Join(acceptedManifestTypes, ", "))
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("registry returned %s fetching manifest %s:%s", resp.Status, repo, reference)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// fetchBlob downloads the blob identified by dgst into layoutDir's
+// blobs/<algo>/<hex>, verifying its digest as it streams.
+func (s *fetchSession) fetchBlob(repo string, dgst digest.Digest, size int64, layoutDir string) error {
+	dest := filepath.Join(layoutDir, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+	if _, err := os.Stat(dest); err == nil {
+		return nil // already have it
+	}
+
+	u := fmt.Sprintf("%s://%s/v2/%s/blobs/%s", s.scheme, registryHost(repo), repoPath(repo), dgst.String())
+	resp, err := s.do(repo, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry returned %s fetching blob %s", resp.Status, dgst)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	verifier := dgst.Verifier()
+	tmp := dest + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.TeeReader(resp.Body, verifier))
+	closeErr := out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if closeErr != nil {
+		os.Remove(tmp)
+		return closeErr
+	}
+	if !verifier.Verified() {
+		os.Remove(tmp)
+		return fmt.Errorf("blob %s failed digest verification", dgst)
+	}
+
+	return os.Rename(tmp, dest)
+}
+
+// do issues method/url, retrying exactly once with a freshly-exchanged
+// bearer token if the registry answers with a 401 carrying a
+// WWW-Authenticate: Bearer challenge, the standard Docker/OCI Distribution
+// auth flow. configure, if non-nil, sets request-specific headers (e.g.
+// Accept) before the first attempt.
+func (s *fetchSession) do(repo, method, url string, configure func(*http.Request)) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if configure != nil {
+		configure(req)
+	}
+	s.setAuth(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("Www-Authenticate")
+	resp.Body.Close()
+
+	if err := s.authenticate(challenge, repo); err != nil {
+		return nil, fmt.Errorf("could not authenticate to registry: %v", err)
+	}
+
+	req, err = http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if configure != nil {
+		configure(req)
+	}
+	s.setAuth(req)
+	return s.client.Do(req)
+}
+
+func (s *fetchSession) setAuth(req *http.Request) {
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+}
+
+// authenticate parses challenge (a WWW-Authenticate: Bearer header) and
+// exchanges s.creds for a token at the realm it names, caching the result
+// on s.token for the rest of this pull.
+func (s *fetchSession) authenticate(challenge, repo string) error {
+	realm, service, scope, ok := parseBearerChallenge(challenge)
+	if !ok {
+		return fmt.Errorf("unsupported auth challenge %q", challenge)
+	}
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repoPath(repo))
+	}
+
+	q := url.Values{}
+	if service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+
+	req, err := http.NewRequest("GET", realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if s.creds.User != "" || s.creds.Password != "" {
+		req.SetBasicAuth(s.creds.User, s.creds.Password)
+	} else if s.creds.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.creds.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("token endpoint %q returned %s", realm, resp.Status)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("could not parse token response: %v", err)
+	}
+	s.token = tokenResp.Token
+	if s.token == "" {
+		s.token = tokenResp.AccessToken
+	}
+	if s.token == "" {
+		return fmt.Errorf("token endpoint %q returned no token", realm)
+	}
+	return nil
+}
+
+// parseBearerChallenge parses a `Bearer realm="...",service="...",scope="..."`
+// WWW-Authenticate header into its component parameters. scope may be ""
+// if the challenge didn't include one (e.g. on a bare /v2/ probe), in
+// which case callers fall back to a default pull scope for the repo.
+func parseBearerChallenge(header string) (realm, service, scope string, ok bool) {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", "", false
+	}
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(header, prefix), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	realm = params["realm"]
+	if realm == "" {
+		return "", "", "", false
+	}
+	return realm, params["service"], params["scope"], true
+}
+
+// initLayout lays down the minimal oci-layout + blobs directory structure
+// a fetch writes into.
+func initLayout(layoutDir string) error {
+	if err := os.MkdirAll(filepath.Join(layoutDir, "blobs"), 0755); err != nil {
+		return err
+	}
+	layout := ociv1.ImageLayout{Version: ociv1.ImageLayoutVersion}
+	b, err := json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(layoutDir, "oci-layout"), b, 0644)
+}
+
+// splitRef splits a docker-style reference ("repo:tag" or "repo@digest")
+// into its repo and reference (tag or digest) parts.
+func splitRef(ref string) (repo, reference string, err error) {
+	if i := strings.LastIndex(ref, "@"); i != -1 {
+		return ref[:i], ref[i+1:], nil
+	}
+	if i := strings.LastIndex(ref, ":"); i != -1 && !strings.Contains(ref[i:], "/") {
+		return ref[:i], ref[i+1:], nil
+	}
+	return ref, "latest", nil
+}
+
+// registryHost and repoPath split a docker-style "host/repo" image name;
+// references with no host component default to Docker Hub, matching the
+// convention every other docker-reference-aware tool in this codebase
+// uses.
+func registryHost(repo string) string {
+	if i := strings.Index(repo, "/"); i != -1 && looksLikeHost(repo[:i]) {
+		return repo[:i]
+	}
+	return "registry-1.docker.io"
+}
+
+func repoPath(repo string) string {
+	if i := strings.Index(repo, "/"); i != -1 && looksLikeHost(repo[:i]) {
+		return repo[i+1:]
+	}
+	if !strings.Contains(repo, "/") {
+		return "library/" + repo
+	}
+	return repo
+}
+
+func looksLikeHost(s string) bool {
+	return strings.Contains(s, ".") || strings.Contains(s, ":") || s == "localhost"
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// PruneFilter selects which images PruneImages should remove. It mirrors
+// libimage/libpod's prune filters; the CRI itself has no equivalent
+// bulk-removal RPC, so this (like PullPolicy) is a plain method rather
+// than an override of a generated interface.
+type PruneFilter struct {
+	// UnusedSinceSeconds, if non-zero, removes images rkt hasn't used in
+	// at least that many seconds, via `rkt image gc --grace-period`.
+	UnusedSinceSeconds int64
+	// Dangling removes images with no docker originalname annotation,
+	// i.e. ones that were never given a recognizable repo:tag.
+	Dangling bool
+	// SizeOverBytes, if non-zero, removes images larger than this size.
+	SizeOverBytes uint64
+}
+
+// PruneResult reports what PruneImages actually did.
+type PruneResult struct {
+	RemovedIDs     []string
+	ReclaimedBytes uint64
+}
+
+// PruneImages removes images matching filter, returning the ids removed
+// and the bytes reclaimed. UnusedSinceSeconds is enforced by delegating to
+// rkt's own `image gc`, which already knows how to find images unreferenced
+// by any pod manifest; Dangling and SizeOverBytes are enforced by this
+// package, removing matches one at a time via `image rm`.
+func (s *ImageStore) PruneImages(filter PruneFilter) (*PruneResult, error) {
+	before, err := s.listCLIEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.UnusedSinceSeconds > 0 {
+		gracePeriod := fmt.Sprintf("%ds", filter.UnusedSinceSeconds)
+		if _, err := s.RunCommand("image", "gc", "--grace-period="+gracePeriod); err != nil {
+			return nil, fmt.Errorf("image gc failed: %v", err)
+		}
+	}
+
+	after, err := s.listCLIEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PruneResult{}
+
+	stillPresent := make(map[string]bool, len(after))
+	for _, e := range after {
+		stillPresent[e.ID] = true
+	}
+	for _, e := range before {
+		if stillPresent[e.ID] {
+			continue
+		}
+		result.RemovedIDs = append(result.RemovedIDs, e.ID)
+		result.ReclaimedBytes += parseSizeOrWarn(e)
+	}
+
+	if !filter.Dangling && filter.SizeOverBytes == 0 {
+		return result, nil
+	}
+
+	for _, e := range after {
+		sz := parseSizeOrWarn(e)
+		if filter.SizeOverBytes != 0 && sz <= filter.SizeOverBytes {
+			continue
+		}
+		if filter.Dangling {
+			realName, _ := s.getImageMetadata(e.ID)
+			if realName != "" {
+				continue
+			}
+		}
+
+		if _, err := s.RunCommand("image", "rm", e.ID); err != nil {
+			glog.Warningf("could not remove image %q during prune: %v", e.ID, err)
+			continue
+		}
+		result.RemovedIDs = append(result.RemovedIDs, e.ID)
+		result.ReclaimedBytes += sz
+	}
+
+	return result, nil
+}
+
+func parseSizeOrWarn(e ImageListEntry) uint64 {
+	sz, err := strconv.ParseUint(e.Size, 10, 64)
+	if err != nil {
+		glog.Warningf("could not parse size for image %q: %v", e.ID, err)
+		return 0
+	}
+	return sz
+}
+
+// ImageFsInfo reports the total size of rkt's image store on disk, so
+// kubelet's disk-pressure eviction can decide whether to invoke
+// PruneImages. The CRI v1alpha1 ImageServiceServer this store implements
+// predates the ImageFsInfo RPC/FilesystemUsage message upstream added for
+// this purpose, so it's exposed as a plain method for whatever shim wires
+// this store up to eviction, rather than as an override of a generated
+// interface method.
+func (s *ImageStore) ImageFsInfo() (usedBytes uint64, err error) {
+	entries, err := s.listCLIEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range entries {
+		usedBytes += parseSizeOrWarn(e)
+	}
+	return usedBytes, nil
+}
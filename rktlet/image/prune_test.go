@@ -0,0 +1,100 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPruneImagesSizeOver(t *testing.T) {
+	listJSON := `[
+		{"id":"sha512-small","name":"docker.io/library/small:latest","importtime":"0","lastused":"0","size":"100"},
+		{"id":"sha512-big","name":"docker.io/library/big:latest","importtime":"0","lastused":"0","size":"1000"}
+	]`
+	var removed []string
+	s := newTestImageStore(&fakeCLI{
+		listJSON: listJSON,
+		otherCall: func(cmd string, args ...string) ([]string, error) {
+			if cmd == "image" && len(args) == 2 && args[0] == "rm" {
+				removed = append(removed, args[1])
+				return []string{""}, nil
+			}
+			return nil, fmt.Errorf("unexpected command: %s %v", cmd, args)
+		},
+	})
+
+	result, err := s.PruneImages(PruneFilter{SizeOverBytes: 500})
+	if err != nil {
+		t.Fatalf("PruneImages: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != "sha512-big" {
+		t.Fatalf("removed %v, want [sha512-big]", removed)
+	}
+	if len(result.RemovedIDs) != 1 || result.RemovedIDs[0] != "sha512-big" {
+		t.Fatalf("result.RemovedIDs = %v, want [sha512-big]", result.RemovedIDs)
+	}
+	if result.ReclaimedBytes != 1000 {
+		t.Errorf("ReclaimedBytes = %d, want 1000", result.ReclaimedBytes)
+	}
+}
+
+func TestPruneImagesDangling(t *testing.T) {
+	listJSON := `[{"id":"sha512-abc","name":"sha512-abc","importtime":"0","lastused":"0","size":"50"}]`
+	var removed []string
+	s := newTestImageStore(&fakeCLI{
+		listJSON: listJSON,
+		otherCall: func(cmd string, args ...string) ([]string, error) {
+			switch {
+			case cmd == "image" && len(args) == 2 && args[0] == "cat-manifest":
+				// No originalname annotation: not a docker-pulled image.
+				return []string{`{"acKind":"ImageManifest","acVersion":"0.8.10","name":"sha512-abc"}`}, nil
+			case cmd == "image" && len(args) == 2 && args[0] == "rm":
+				removed = append(removed, args[1])
+				return []string{""}, nil
+			}
+			return nil, fmt.Errorf("unexpected command: %s %v", cmd, args)
+		},
+	})
+
+	result, err := s.PruneImages(PruneFilter{Dangling: true})
+	if err != nil {
+		t.Fatalf("PruneImages: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != "sha512-abc" {
+		t.Fatalf("removed %v, want [sha512-abc]", removed)
+	}
+	if result.ReclaimedBytes != 50 {
+		t.Errorf("ReclaimedBytes = %d, want 50", result.ReclaimedBytes)
+	}
+}
+
+func TestImageFsInfo(t *testing.T) {
+	listJSON := `[
+		{"id":"sha512-a","name":"a","importtime":"0","lastused":"0","size":"100"},
+		{"id":"sha512-b","name":"b","importtime":"0","lastused":"0","size":"250"}
+	]`
+	s := newTestImageStore(&fakeCLI{listJSON: listJSON})
+
+	used, err := s.ImageFsInfo()
+	if err != nil {
+		t.Fatalf("ImageFsInfo: %v", err)
+	}
+	if used != 350 {
+		t.Errorf("ImageFsInfo = %d, want 350", used)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package image
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kubernetes-incubator/rktlet/rktlet/util"
+
+	context "golang.org/x/net/context"
+	"k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+)
+
+// PullPolicy mirrors podman's --pull={missing,always,never,newer}: it
+// decides whether PullImageWithPolicy needs to talk to the registry at
+// all for an image that may already be present locally.
+type PullPolicy string
+
+const (
+	// PullPolicyMissing only pulls if the image isn't already present.
+	PullPolicyMissing PullPolicy = "missing"
+	// PullPolicyAlways always pulls, regardless of what's local.
+	PullPolicyAlways PullPolicy = "always"
+	// PullPolicyNever never pulls; it errors if the image is absent.
+	PullPolicyNever PullPolicy = "never"
+	// PullPolicyNewer pulls only if the registry's manifest digest
+	// differs from the digest the local image was pulled under.
+	PullPolicyNewer PullPolicy = "newer"
+)
+
+// PullImageWithPolicy runs an additional check, before ever fetching
+// anything, for whether a pull is actually needed under policy; PullImage
+// itself calls this with PullPolicyMissing. Concurrent calls for the same
+// normalized image reference are coalesced through s.pullGroup, so N pods
+// scheduled at once with the same image trigger exactly one fetch.
+func (s *ImageStore) PullImageWithPolicy(ctx context.Context, req *runtime.PullImageRequest, policy PullPolicy) (*runtime.PullImageResponse, error) {
+	ref := *req.Image.Image
+
+	local, err := s.findImage(ctx, req.Image)
+	if err != nil && err != ErrImageNotFound {
+		return nil, err
+	}
+	present := err == nil
+
+	switch policy {
+	case PullPolicyNever:
+		if !present {
+			return nil, fmt.Errorf("image %q is not present and pull policy is %q", ref, PullPolicyNever)
+		}
+		return &runtime.PullImageResponse{}, nil
+	case PullPolicyMissing, "":
+		if present {
+			return &runtime.PullImageResponse{}, nil
+		}
+	case PullPolicyNewer:
+		if present {
+			uptodate, err := s.localImageIsUpToDate(local, ref)
+			if err != nil {
+				return nil, err
+			}
+			if uptodate {
+				return &runtime.PullImageResponse{}, nil
+			}
+		}
+	case PullPolicyAlways:
+		// always falls through to the fetch below
+	default:
+		return nil, fmt.Errorf("unknown pull policy %q", policy)
+	}
+
+	v, err, _ := s.pullGroup.Do(normalizeImageRef(ref), func() (interface{}, error) {
+		return s.fetchImage(ctx, req)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*runtime.PullImageResponse), nil
+}
+
+// localImageIsUpToDate compares local's recorded manifest digest against
+// the registry's current one for ref, via a HEAD request (the same way
+// docker/containerd resolve PullPolicyNewer without pulling the manifest
+// body). If the registry doesn't return a digest, the local copy is
+// conservatively treated as stale so the caller re-pulls rather than
+// risks running a silently outdated image.
+func (s *ImageStore) localImageIsUpToDate(local *runtime.Image, ref string) (bool, error) {
+	remoteDigest, err := remoteManifestDigest(ref)
+	if err != nil {
+		return false, err
+	}
+	if remoteDigest == "" {
+		return false, nil
+	}
+
+	for _, rd := range local.RepoDigests {
+		if strings.HasSuffix(rd, remoteDigest) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// remoteManifestDigest HEADs ref's manifest and returns the
+// Docker-Content-Digest the registry answers with, without pulling the
+// manifest body.
+func remoteManifestDigest(ref string) (string, error) {
+	repo, reference, err := splitRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registryHost(repo), repoPath(repo), reference)
+	httpReq, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+	httpReq.Header.Set("Accept", strings.Join(acceptedManifestTypes, ", "))
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("could not check remote manifest for %q: %v", ref, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry returned %s checking manifest for %q", resp.Status, ref)
+	}
+
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// normalizeImageRef is the singleflight key for a pull: two requests for
+// the same image that only differ by an implicit ":latest" should still
+// coalesce into one fetch.
+func normalizeImageRef(ref string) string {
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+	normalized, err := util.ApplyDefaultImageTag(ref)
+	if err != nil {
+		return ref
+	}
+	return normalized
+}
@@ -18,10 +18,15 @@ package runtime
 
 import (
 	"bytes"
-	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/kr/pty"
 
 	"github.com/kubernetes-incubator/rktlet/rktlet/cli"
 	"golang.org/x/net/context"
@@ -31,6 +36,10 @@ import (
 	"k8s.io/kubernetes/pkg/util/term"
 )
 
+// rktPodDir is where rkt keeps its per-pod runtime state, including the
+// network namespace handle each pod's stage1 bind-mounts for its lifetime.
+const rktPodDir = "/var/lib/rkt/pods/run"
+
 func (r *RktRuntime) Attach(ctx context.Context, req *runtimeapi.AttachRequest) (*runtimeapi.AttachResponse, error) {
 	// TODO, the second parameter here needs to be retrieved from the
 	// `ContainerConfig` associated with the req.ContainerID
@@ -41,29 +50,43 @@ func (r *RktRuntime) Exec(ctx context.Context, req *runtimeapi.ExecRequest) (*ru
 	return r.streamServer.GetExec(req)
 }
 
-type nopWriteCloser bytes.Buffer
-
-func (n nopWriteCloser) Bytes() []byte {
-	return n.Bytes()
+// nopWriteCloser adapts a bytes.Buffer to the io.WriteCloser execShim.Exec
+// expects, without closing (or infinitely recursing into) the buffer.
+type nopWriteCloser struct {
+	*bytes.Buffer
 }
 
-func (n nopWriteCloser) Write(p []byte) (int, error) {
-	return n.Write(p)
+func newNopWriteCloser() *nopWriteCloser {
+	return &nopWriteCloser{&bytes.Buffer{}}
 }
 
-func (nopWriteCloser) Close() error {
+func (*nopWriteCloser) Close() error {
 	return nil
 }
 
+// ExitError is returned by execShim.Exec when the child process ran to
+// completion but exited non-zero, so callers that need the exit status
+// (e.g. ExecSync) don't have to re-derive it from the process state.
+type ExitError struct {
+	error
+	ExitCode int32
+}
+
 func (r *RktRuntime) ExecSync(ctx context.Context, req *runtimeapi.ExecSyncRequest) (*runtimeapi.ExecSyncResponse, error) {
 	nopStdin := ioutil.NopCloser(bytes.NewReader([]byte{}))
-	var stdout, stderr nopWriteCloser
+	stdout := newNopWriteCloser()
+	stderr := newNopWriteCloser()
+
+	var exitCode int32
 	err := r.execShim.Exec(req.GetContainerId(), req.GetCmd(), nopStdin, stdout, stderr, false, make(chan term.Size))
 	if err != nil {
-		return nil, err
+		exitErr, ok := err.(*ExitError)
+		if !ok {
+			return nil, err
+		}
+		exitCode = exitErr.ExitCode
 	}
 
-	var exitCode int32 = 0 // TODO
 	return &runtimeapi.ExecSyncResponse{
 		ExitCode: &exitCode,
 		Stderr:   stderr.Bytes(),
@@ -85,11 +108,19 @@ func NewExecShim(cli cli.CLI) *execShim {
 	return &execShim{cli: cli}
 }
 
-func (es *execShim) Attach(containerID string, in io.Reader, out, err io.WriteCloser, resize <-chan term.Size) error {
-	return errors.New("TODO")
+// Attach attaches to a running app by exec'ing a shell into it over a pty.
+// rkt has no way to re-attach to the stdio of the original entrypoint, so
+// this gives the caller an interactive session in the app's namespaces
+// instead, which is what kubectl attach/exec -it actually need in practice.
+func (es *execShim) Attach(containerID string, in io.Reader, out, errOut io.WriteCloser, resize <-chan term.Size) error {
+	return es.exec(containerID, []string{"/bin/sh"}, in, out, errOut, true, resize)
 }
 
 func (es *execShim) Exec(containerID string, cmd []string, in io.Reader, out, errOut io.WriteCloser, tty bool, resize <-chan term.Size) error {
+	return es.exec(containerID, cmd, in, out, errOut, tty, resize)
+}
+
+func (es *execShim) exec(containerID string, cmd []string, in io.Reader, out, errOut io.WriteCloser, tty bool, resize <-chan term.Size) error {
 	uuid, appName, err := parseContainerID(containerID)
 	if err != nil {
 		return err
@@ -104,6 +135,10 @@ func (es *execShim) Exec(containerID string, cmd []string, in io.Reader, out, er
 	rktCommand := es.cli.Command(cmdList[0], cmdList[1:]...)
 	execCmd := exec.Command(rktCommand[0], rktCommand[1:]...)
 
+	if tty {
+		return runTTY(execCmd, in, out, resize)
+	}
+
 	// At most one error will happen in each of the following goroutines.
 	errCh := make(chan error, 4)
 	done := make(chan struct{})
@@ -121,8 +156,106 @@ func (es *execShim) Exec(containerID string, cmd []string, in io.Reader, out, er
 	}
 }
 
+// runTTY starts cmd attached to a pty, copies stdin/stdout through it, and
+// forwards window-size changes from resize to the pty via TIOCSWINSZ for as
+// long as the command is running.
+func runTTY(cmd *exec.Cmd, in io.Reader, out io.WriteCloser, resize <-chan term.Size) error {
+	ptmx, err := pty.Start(cmd)
+	if err != nil {
+		return err
+	}
+	defer ptmx.Close()
+
+	resizeDone := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case size, ok := <-resize:
+				if !ok {
+					return
+				}
+				pty.Setsize(ptmx, &pty.Winsize{Rows: size.Height, Cols: size.Width})
+			case <-resizeDone:
+				return
+			}
+		}
+	}()
+
+	go io.Copy(ptmx, in)
+	copyDone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, ptmx)
+		copyDone <- err
+	}()
+
+	waitErr := waitExitErr(cmd)
+	close(resizeDone)
+	<-copyDone
+	return waitErr
+}
+
+// PortForward proxies stream to the given port inside the pod's network
+// namespace by entering that namespace with nsenter and speaking to the
+// port with socat, the same approach dockershim and cri-o used before they
+// grew native port-forward support.
 func (es *execShim) PortForward(sandboxID string, port int32, stream io.ReadWriteCloser) error {
-	return errors.New("TODO")
+	uuid, _, err := parseContainerID(sandboxID)
+	if err != nil {
+		return err
+	}
+
+	netns, err := podNetNS(uuid)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("nsenter", fmt.Sprintf("--net=%s", netns), "--",
+		"socat", "-", fmt.Sprintf("TCP4:127.0.0.1:%d", port))
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = stream
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("couldn't start socat: %v", err)
+	}
+
+	copyErrCh := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdin, stream)
+		stdin.Close()
+		copyErrCh <- err
+	}()
+
+	waitErr := cmd.Wait()
+
+	// If the backend process exited first, the stdin-copy goroutine above
+	// can still be blocked reading from stream waiting on the client,
+	// which may never send anything else or close its end on its own;
+	// blocking here for it unconditionally could hang this call forever.
+	// Only take its error if it's already finished; otherwise let it run
+	// to completion in the background, which it will once the caller
+	// closes stream after PortForward returns.
+	select {
+	case copyErr := <-copyErrCh:
+		if copyErr != nil && waitErr == nil {
+			return copyErr
+		}
+	default:
+	}
+	return waitErr
+}
+
+// podNetNS returns the path to the network namespace handle rkt bind-mounts
+// for the pod identified by uuid, suitable for passing to `nsenter --net=`.
+func podNetNS(uuid string) (string, error) {
+	netns := filepath.Join(rktPodDir, uuid, "netns")
+	if _, err := os.Stat(netns); err != nil {
+		return "", fmt.Errorf("couldn't find network namespace for pod %q: %v", uuid, err)
+	}
+	return netns, nil
 }
 
 func streamStdin(cmd *exec.Cmd, in io.Reader, errCh chan error) {
@@ -167,10 +300,29 @@ func run(cmd *exec.Cmd, errCh chan error, done chan struct{}) {
 		errCh <- err
 		return
 	}
-	if err := cmd.Wait(); err != nil {
+	if err := waitExitErr(cmd); err != nil {
 		errCh <- err
 		return
 	}
 	close(done)
 	return
 }
+
+// waitExitErr waits for cmd to finish, wrapping a non-zero exit in an
+// *ExitError so callers can recover the exit status without re-inspecting
+// the process state themselves.
+func waitExitErr(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	if err == nil {
+		return nil
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return err
+	}
+	return &ExitError{error: exitErr, ExitCode: int32(status.ExitStatus())}
+}
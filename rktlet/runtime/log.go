@@ -17,53 +17,93 @@ limitations under the License.
 package runtime
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
 	"strings"
+	"sync"
 
-	"golang.org/x/net/context"
-
-	runtimeapi "k8s.io/kubernetes/pkg/kubelet/api/v1alpha1/runtime"
+	"github.com/golang/glog"
+	"github.com/kubernetes-incubator/rktlet/journal2cri/journal2cri"
 )
 
-const loggingHelperImage = "quay.io/coreos/rktlet-journal2cri:0.0.1"
-const loggingAppName = "journal2cri-rktletinternal"
-
-func (r *RktRuntime) initializeLoggingAppImage(ctx context.Context) error {
-	imageName := loggingHelperImage
-	_, err := r.imageStore.PullImage(ctx, &runtimeapi.PullImageRequest{
-		Image: &runtimeapi.ImageSpec{
-			Image: &imageName,
-		},
-	})
-	return err
+// podLogFollower tracks the in-process journal follower started for a pod
+// so it can be torn down again on StopPodSandbox.
+type podLogFollower struct {
+	writer *journal2cri.Writer
+	cancel context.CancelFunc
 }
 
-// addInternalLoggingApp adds the helper app for converting journald logs for this pod to cri logs
-func (r *RktRuntime) addInternalLoggingApp(rktUUID string, criLogDir string) error {
+// logFollowers guards the map of per-pod followers started by
+// startPodLogging; rktUUID -> follower.
+var (
+	logFollowersMu sync.Mutex
+	logFollowers   = map[string]*podLogFollower{}
+)
+
+// startPodLogging replaces the old journal2cri sidecar app: instead of
+// injecting a helper container into the pod that bind-mounts the pod
+// journal and shells logs out through it, it starts an in-process
+// follower that reads the pod's journal directory directly and writes CRI
+// log files, avoiding the extra image pull, mount plumbing, and
+// cgroup/PID overhead of a helper app per pod.
+//
+// NOTE: this is meant to be called from RunPodSandbox, with
+// stopPodLogging called from StopPodSandbox, the same way
+// addInternalLoggingApp (the sidecar this replaced) was tied to the pod
+// lifecycle. Neither RunPodSandbox/StopPodSandbox nor the RktRuntime type
+// they'd hang off of are present in this source tree, so there is no call
+// site to wire these into here; whatever defines RktRuntime's sandbox
+// lifecycle methods needs to call startPodLogging/stopPodLogging at the
+// start/end of a pod's sandbox, same as addInternalLoggingApp's caller
+// did.
+func (r *RktRuntime) startPodLogging(rktUUID, criLogDir string) error {
 	if criLogDir == "" {
 		return fmt.Errorf("unable to start logging: no cri log directory provided")
 	}
 
-	imageHash, err := r.getImageHash(loggingHelperImage)
-	if err != nil {
-		return err
-	}
+	rktJournalDir := filepath.Join("/var/log/journal", strings.Replace(rktUUID, "-", "", -1))
 
-	rktJournalDir := filepath.Join("var", "log", "journal", strings.Replace(rktUUID, "-", "", -1))
+	writer := journal2cri.NewWriter(criLogDir, journal2cri.WriterOptions{
+		MaxOpenFiles: 16,
+		Rotation: journal2cri.RotationPolicy{
+			MaxSizeBytes: 10 * 1024 * 1024,
+			MaxFiles:     5,
+		},
+	})
+	follower := journal2cri.NewFollower(rktJournalDir, journal2cri.FollowerOptions{
+		Writer:        writer,
+		CursorFile:    filepath.Join(criLogDir, ".journal2cri-cursor"),
+		PartialWindow: journal2cri.DefaultPartialWindow,
+	})
 
-	cmd := []string{"app", "add", rktUUID, imageHash}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		if err := follower.Run(ctx); err != nil {
+			glog.Warningf("journal follower for pod %q exited: %v", rktUUID, err)
+		}
+	}()
+	go writer.HandleSignals(ctx)
+
+	logFollowersMu.Lock()
+	logFollowers[rktUUID] = &podLogFollower{writer: writer, cancel: cancel}
+	logFollowersMu.Unlock()
+	return nil
+}
 
-	cmd = append(cmd, "--name=journal2cri-"+loggingAppName)
-	cmd = append(cmd, fmt.Sprintf("--mnt-volume=name=journal,kind=host,source=%s,target=/journal,readOnly=true"), rktJournalDir)
-	cmd = append(cmd, fmt.Sprintf("--mnt-volume=name=cri,kind=host,source=%s,target=/cri,readOnly=false"), criLogDir)
+// stopPodLogging stops the follower started by startPodLogging for
+// rktUUID, if any, and flushes its open log handles.
+func (r *RktRuntime) stopPodLogging(rktUUID string) {
+	logFollowersMu.Lock()
+	f, ok := logFollowers[rktUUID]
+	delete(logFollowers, rktUUID)
+	logFollowersMu.Unlock()
 
-	if _, err := r.RunCommand(cmd[0], cmd[1:]...); err != nil {
-		return err
+	if !ok {
+		return
 	}
-
-	if _, err := r.RunCommand("app", "start", rktUUID, "--app="+loggingAppName); err != nil {
-		return err
+	f.cancel()
+	if err := f.writer.Close(); err != nil {
+		glog.Warningf("could not close log handles for pod %q: %v", rktUUID, err)
 	}
-	return nil
 }
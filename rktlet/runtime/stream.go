@@ -0,0 +1,241 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/websocket"
+
+	"k8s.io/kubernetes/pkg/kubelet/server/streaming"
+	"k8s.io/kubernetes/pkg/util/term"
+)
+
+// Channel indexes used by the websocket framing for exec/attach, matching
+// the convention the upstream kubelet remotecommand websocket transport
+// uses: one binary websocket message per write to these streams, prefixed
+// with its channel byte.
+const (
+	wsChannelStdin = iota
+	wsChannelStdout
+	wsChannelStderr
+	wsChannelError
+	wsChannelResize
+)
+
+// StreamServerConfig wraps streaming.Config with rktlet-specific options.
+// EnableWebsocket selects whether the WebSocket transport served by
+// NewWebsocketHandler (for clients behind HTTP/1.1-only proxies and
+// browser-based kubectl replacements, which can't negotiate SPDY) is
+// offered alongside SPDY. Nothing in this package reads it or mounts
+// NewWebsocketHandler; whatever builds the stream server does both.
+type StreamServerConfig struct {
+	streaming.Config
+	EnableWebsocket bool
+}
+
+// wsStream multiplexes a single websocket connection into the
+// stdin/stdout/stderr/resize streams execShim expects, using one leading
+// channel byte per message the way the kubelet's own websocket
+// implementations for remotecommand and portforward do.
+//
+// Only one goroutine (demux) ever calls Receive on the underlying
+// connection; it fans incoming stdin and resize frames out to a pipe and a
+// channel respectively, so stdin() and resize() can be consumed
+// concurrently without racing each other for frames off the wire.
+type wsStream struct {
+	conn *websocket.Conn
+
+	demuxOnce sync.Once
+	stdinR    *io.PipeReader
+	stdinW    *io.PipeWriter
+	resizeCh  chan term.Size
+}
+
+func newWSStream(conn *websocket.Conn) *wsStream {
+	conn.PayloadType = websocket.BinaryFrame
+	stdinR, stdinW := io.Pipe()
+	return &wsStream{
+		conn:     conn,
+		stdinR:   stdinR,
+		stdinW:   stdinW,
+		resizeCh: make(chan term.Size, 1),
+	}
+}
+
+// stdin returns an io.Reader that yields bytes received on wsChannelStdin.
+func (s *wsStream) stdin() io.Reader {
+	s.startDemux()
+	return s.stdinR
+}
+
+// writer returns an io.WriteCloser that frames writes under the given
+// channel and sends them as individual websocket messages.
+func (s *wsStream) writer(channel byte) io.WriteCloser {
+	return &wsChannelWriter{stream: s, channel: channel}
+}
+
+// resize returns a channel fed by parsing wsChannelResize messages
+// (encoded as "WIDTHxHEIGHT") into term.Size values, for use as the
+// resize channel passed to execShim.Exec/Attach.
+func (s *wsStream) resize() <-chan term.Size {
+	s.startDemux()
+	return s.resizeCh
+}
+
+// startDemux starts the single goroutine that reads frames off the
+// connection and dispatches them to stdin/resize consumers. It's
+// idempotent so stdin() and resize() can each call it regardless of order.
+func (s *wsStream) startDemux() {
+	s.demuxOnce.Do(func() {
+		go s.demux()
+	})
+}
+
+// demux is the sole reader of s.conn. It dispatches wsChannelStdin payloads
+// to stdinW and wsChannelResize payloads to resizeCh; other channels aren't
+// expected from the client and are ignored.
+func (s *wsStream) demux() {
+	defer s.stdinW.Close()
+	defer close(s.resizeCh)
+	for {
+		channel, payload, err := s.readMessage()
+		if err != nil {
+			return
+		}
+		switch channel {
+		case wsChannelStdin:
+			if _, err := s.stdinW.Write(payload); err != nil {
+				return
+			}
+		case wsChannelResize:
+			size, ok := parseTermSize(payload)
+			if !ok {
+				continue
+			}
+			s.resizeCh <- size
+		}
+	}
+}
+
+func (s *wsStream) readMessage() (byte, []byte, error) {
+	var msg []byte
+	if err := websocket.Message.Receive(s.conn, &msg); err != nil {
+		return 0, nil, err
+	}
+	if len(msg) == 0 {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return msg[0], msg[1:], nil
+}
+
+func (s *wsStream) writeMessage(channel byte, p []byte) error {
+	msg := make([]byte, len(p)+1)
+	msg[0] = channel
+	copy(msg[1:], p)
+	return websocket.Message.Send(s.conn, msg)
+}
+
+type wsChannelWriter struct {
+	stream  *wsStream
+	channel byte
+}
+
+func (w *wsChannelWriter) Write(p []byte) (int, error) {
+	if err := w.stream.writeMessage(w.channel, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *wsChannelWriter) Close() error {
+	return nil
+}
+
+// parseTermSize parses the "WIDTHxHEIGHT" resize payload kubectl sends on
+// wsChannelResize.
+func parseTermSize(payload []byte) (term.Size, bool) {
+	var width, height uint16
+	n, err := fmt.Sscanf(string(payload), "%dx%d", &width, &height)
+	if err != nil || n != 2 {
+		return term.Size{}, false
+	}
+	return term.Size{Width: width, Height: height}, true
+}
+
+// NewWebsocketHandler returns an http.Handler that upgrades incoming
+// requests to WebSocket and drives them through execShim, as an
+// alternative to the SPDY path streamServer otherwise serves, for clients
+// that can't negotiate SPDY (HTTP/1.1-only proxies, browser-based kubectl
+// replacements). This package does not mount it; the caller mounts it
+// alongside (not instead of) the normal streaming.Server when
+// StreamServerConfig.EnableWebsocket is set.
+func NewWebsocketHandler(execShim streaming.Runtime) http.Handler {
+	return websocket.Handler(func(conn *websocket.Conn) {
+		req := conn.Request()
+		stream := newWSStream(conn)
+
+		containerID := req.URL.Query().Get("container")
+		if containerID == "" {
+			return
+		}
+
+		if portStr := req.URL.Query().Get("port"); portStr != "" {
+			port, err := strconv.ParseInt(portStr, 10, 32)
+			if err != nil {
+				return
+			}
+			execShim.PortForward(containerID, int32(port), wsReadWriteCloser{stream})
+			return
+		}
+
+		tty := req.URL.Query().Get("tty") == "true"
+		cmd := req.URL.Query()["command"]
+
+		stdout := stream.writer(wsChannelStdout)
+		stderr := stream.writer(wsChannelStderr)
+
+		if req.URL.Query().Get("attach") == "true" {
+			execShim.Attach(containerID, stream.stdin(), stdout, stderr, stream.resize())
+			return
+		}
+		execShim.Exec(containerID, cmd, stream.stdin(), stdout, stderr, tty, stream.resize())
+	})
+}
+
+// wsReadWriteCloser adapts a wsStream to the io.ReadWriteCloser
+// execShim.PortForward expects: reads come from wsChannelStdin (0) and
+// writes go out on wsChannelStdout (1).
+type wsReadWriteCloser struct {
+	*wsStream
+}
+
+func (w wsReadWriteCloser) Read(p []byte) (int, error) {
+	return w.stdin().Read(p)
+}
+
+func (w wsReadWriteCloser) Write(p []byte) (int, error) {
+	return w.writer(wsChannelStdout).Write(p)
+}
+
+func (w wsReadWriteCloser) Close() error {
+	return w.conn.Close()
+}